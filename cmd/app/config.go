@@ -0,0 +1,274 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package app
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/brgpu"
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/config"
+)
+
+// configFile returns the config file named by --config or the environment.
+func (o *Options) configFile() string {
+	if o.configPath != "" {
+		return o.configPath
+	}
+	return os.Getenv(config.EnvFile)
+}
+
+// config returns the settings of o as a config file would hold them.
+func (o *Options) config() config.Config {
+	return config.Config{
+		Version:             config.Version,
+		Mode:                o.mode,
+		Runtime:             o.runtime,
+		Pulse:               o.pulse,
+		HealthCheckInterval: o.healthCheckInterval,
+		RediscoverInterval:  o.rediscoverInterval,
+		InitTolerateLevel:   o.initModeTolerateLevel,
+		GPUPartitionSize:    o.gpuPartitionSize,
+		MetricsAddress:      o.metricsAddress,
+		CDI: config.CDI{
+			Enabled:      brgpu.CdiFeature,
+			Overwrite:    brgpu.OverwriteCdiConfig,
+			RemoveOnExit: brgpu.RemoveCdiConfig,
+		},
+		Mounts: config.Mounts{
+			HostPath:        o.mountHostPath,
+			PluginMountPath: o.pluginMountPath,
+			AllDevices:      o.mountAllDevice,
+			DRIDevices:      o.mountDriDevice,
+		},
+		Allocation: config.Allocation{
+			Policy:    o.allocationPolicy,
+			SVIPolicy: o.sviPolicy,
+		},
+		Resources: config.Resources{
+			GPUName:          brgpu.GPUResourceName,
+			DeviceIDStrategy: o.deviceIDStrategy,
+			Namespace:        brgpu.ResourceNaming.Namespace,
+			WholeName:        brgpu.ResourceNaming.Whole,
+			SplitName:        brgpu.ResourceNaming.Split,
+			Aliases:          brgpu.ResourceNaming.Aliases,
+		},
+		Sharing: config.Sharing{
+			Replicas:   o.replicas,
+			Rename:     o.renameShared,
+			MemoryUnit: o.gpuMemoryUnit,
+		},
+	}
+}
+
+// merge returns cfg with the settings given on the command line, flags win
+// over the config file.
+func (o *Options) merge(cfg config.Config) config.Config {
+	cur := o.config()
+	changed := func(name string) bool {
+		return o.flags != nil && o.flags.Changed(name)
+	}
+	if changed("mode") {
+		cfg.Mode = cur.Mode
+	}
+	if changed("container-runtime") {
+		cfg.Runtime = cur.Runtime
+	}
+	if changed("pulse") {
+		cfg.Pulse = cur.Pulse
+	}
+	if changed("health-check-interval") {
+		cfg.HealthCheckInterval = cur.HealthCheckInterval
+	}
+	if changed("rediscover-interval") {
+		cfg.RediscoverInterval = cur.RediscoverInterval
+	}
+	if changed("init-mode-tolerate-level") {
+		cfg.InitTolerateLevel = cur.InitTolerateLevel
+	}
+	if changed("gpu-partition-size") {
+		cfg.GPUPartitionSize = cur.GPUPartitionSize
+	}
+	if changed("metrics-address") {
+		cfg.MetricsAddress = cur.MetricsAddress
+	}
+	if changed("cdi-feature") {
+		cfg.CDI.Enabled = cur.CDI.Enabled
+	}
+	if changed("overwrite-cdi-config") {
+		cfg.CDI.Overwrite = cur.CDI.Overwrite
+	}
+	if changed("remove-cdi-config") {
+		cfg.CDI.RemoveOnExit = cur.CDI.RemoveOnExit
+	}
+	if changed("mount-host-path") {
+		cfg.Mounts.HostPath = cur.Mounts.HostPath
+	}
+	if changed("plugin-mount-path") {
+		cfg.Mounts.PluginMountPath = cur.Mounts.PluginMountPath
+	}
+	if changed("mount-all-device") {
+		cfg.Mounts.AllDevices = cur.Mounts.AllDevices
+	}
+	if changed("mount-dri-device") {
+		cfg.Mounts.DRIDevices = cur.Mounts.DRIDevices
+	}
+	if changed("allocation-policy") {
+		cfg.Allocation.Policy = cur.Allocation.Policy
+	}
+	if changed("svi-policy") {
+		cfg.Allocation.SVIPolicy = cur.Allocation.SVIPolicy
+	}
+	if changed("device-id-strategy") {
+		cfg.Resources.DeviceIDStrategy = cur.Resources.DeviceIDStrategy
+	}
+	if changed("resource-namespace") {
+		cfg.Resources.Namespace = cur.Resources.Namespace
+	}
+	if changed("whole-resource-name") {
+		cfg.Resources.WholeName = cur.Resources.WholeName
+	}
+	if changed("split-resource-name") {
+		cfg.Resources.SplitName = cur.Resources.SplitName
+	}
+	if changed("resource-aliases") {
+		cfg.Resources.Aliases = cur.Resources.Aliases
+	}
+	if changed("replicas") {
+		cfg.Sharing.Replicas = cur.Sharing.Replicas
+	}
+	if changed("rename-shared-resources") {
+		cfg.Sharing.Rename = cur.Sharing.Rename
+	}
+	if changed("gpu-memory-unit") {
+		cfg.Sharing.MemoryUnit = cur.Sharing.MemoryUnit
+	}
+	return cfg
+}
+
+// setConfig makes cfg the settings of o.
+func (o *Options) setConfig(cfg config.Config) {
+	o.mode = cfg.Mode
+	o.runtime = cfg.Runtime
+	o.pulse = cfg.Pulse
+	o.healthCheckInterval = cfg.HealthCheckInterval
+	o.rediscoverInterval = cfg.RediscoverInterval
+	o.initModeTolerateLevel = cfg.InitTolerateLevel
+	o.gpuPartitionSize = cfg.GPUPartitionSize
+	o.metricsAddress = cfg.MetricsAddress
+	brgpu.CdiFeature = cfg.CDI.Enabled
+	brgpu.OverwriteCdiConfig = cfg.CDI.Overwrite
+	brgpu.RemoveCdiConfig = cfg.CDI.RemoveOnExit
+	o.mountHostPath = cfg.Mounts.HostPath
+	o.pluginMountPath = cfg.Mounts.PluginMountPath
+	o.mountAllDevice = cfg.Mounts.AllDevices
+	o.mountDriDevice = cfg.Mounts.DRIDevices
+	o.allocationPolicy = cfg.Allocation.Policy
+	o.sviPolicy = cfg.Allocation.SVIPolicy
+	brgpu.GPUResourceName = cfg.Resources.GPUName
+	o.deviceIDStrategy = cfg.Resources.DeviceIDStrategy
+	brgpu.ResourceNaming = brgpu.Naming{
+		Namespace: cfg.Resources.Namespace,
+		Whole:     cfg.Resources.WholeName,
+		Split:     cfg.Resources.SplitName,
+		Aliases:   cfg.Resources.Aliases,
+	}
+	o.replicas = cfg.Sharing.Replicas
+	o.renameShared = cfg.Sharing.Rename
+	o.gpuMemoryUnit = cfg.Sharing.MemoryUnit
+}
+
+// configMap returns the namespace and name of --config-map, the namespace
+// defaults to the one of the pod.
+func (o *Options) configMap() (string, string, error) {
+	namespace, name := os.Getenv("POD_NAMESPACE"), o.configMapRef
+	if i := strings.Index(name, "/"); i >= 0 {
+		namespace, name = name[:i], name[i+1:]
+	}
+	if namespace == "" || name == "" {
+		return "", "", fmt.Errorf("invalid config map %q, use namespace/name or set POD_NAMESPACE", o.configMapRef)
+	}
+	return namespace, name, nil
+}
+
+// reload applies the settings of cfg that can change while serving and
+// returns the others, which need a restart. Nothing is applied when the
+// allocation policies of cfg are invalid.
+func (o *Options) reload(cfg config.Config, bgm interface{ Reload(brgpu.Settings) }) ([]string, error) {
+	cfg = o.merge(cfg)
+	cur := o.config()
+	restart := []string{}
+	if cfg.Mode != cur.Mode {
+		restart = append(restart, "mode")
+	}
+	if cfg.Runtime != cur.Runtime {
+		restart = append(restart, "runtime")
+	}
+	if cfg.Pulse != cur.Pulse {
+		restart = append(restart, "pulse")
+	}
+	if cfg.HealthCheckInterval != cur.HealthCheckInterval {
+		restart = append(restart, "healthCheckInterval")
+	}
+	if cfg.RediscoverInterval != cur.RediscoverInterval {
+		restart = append(restart, "rediscoverInterval")
+	}
+	if cfg.InitTolerateLevel != cur.InitTolerateLevel {
+		restart = append(restart, "initTolerateLevel")
+	}
+	if cfg.GPUPartitionSize != cur.GPUPartitionSize {
+		restart = append(restart, "gpuPartitionSize")
+	}
+	if cfg.MetricsAddress != cur.MetricsAddress {
+		restart = append(restart, "metricsAddress")
+	}
+	if cfg.CDI != cur.CDI {
+		restart = append(restart, "cdi")
+	}
+	if cfg.Mounts.PluginMountPath != cur.Mounts.PluginMountPath {
+		restart = append(restart, "mounts.pluginMountPath")
+	}
+	if cfg.Resources != cur.Resources {
+		restart = append(restart, "resources")
+	}
+	if cfg.Sharing != cur.Sharing {
+		restart = append(restart, "sharing")
+	}
+
+	svi, err := brgpu.ParseSVIPolicy(cfg.Allocation.SVIPolicy)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := brgpu.NewPolicy(cfg.Allocation.Policy, svi)
+	if err != nil {
+		return nil, err
+	}
+	o.allocationPolicy = cfg.Allocation.Policy
+	o.sviPolicy = cfg.Allocation.SVIPolicy
+	o.mountAllDevice = cfg.Mounts.AllDevices
+	o.mountDriDevice = cfg.Mounts.DRIDevices
+	o.mountHostPath = cfg.Mounts.HostPath
+	bgm.Reload(brgpu.Settings{
+		Policy:         policy,
+		SVIPolicy:      svi,
+		MountHostPath:  cfg.Mounts.HostPath,
+		MountDriDevice: cfg.Mounts.DRIDevices,
+		MountAllDevice: cfg.Mounts.AllDevices,
+	})
+	log.Infof("Reloaded allocation policy %s, svi policy %s, mounts %+v", policy.Name(), svi, cfg.Mounts)
+	return restart, nil
+}
@@ -14,52 +14,335 @@
 package app
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/BirenTechnology/k8s-device-plugin/pkg/brgpu"
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/config"
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/metrics"
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/podresources"
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/utils"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 )
 
+const (
+	modePlugin   = config.ModePlugin
+	modeExporter = config.ModeExporter
+	modeAll      = config.ModeAll
+
+	defaultMetricsAddress = ":9400"
+)
+
 type Options struct {
+	configPath            string
+	configMapRef          string
+	flags                 *pflag.FlagSet
 	mode                  string
 	pluginMountPath       string
 	pulse                 int
 	initModeTolerateLevel int
 	mountAllDevice        bool
 	mountDriDevice        bool
+	mountHostPath         bool
 	runtime               string
+	fakeBackend           string
+	healthCheckInterval   int
+	rediscoverInterval    int
+	sviPolicy             string
+	allocationPolicy      string
+	gpuPartitionSize      string
+	metricsAddress        string
+	exporterInterval      int
+	podResourcesSocket    string
+	podResourcesInterval  int
+	nodeLabels            bool
+	replicas              string
+	renameShared          bool
+	gpuMemoryUnit         string
+	deviceIDStrategy      string
 }
 
 func NewOptions() *Options {
-	return &Options{}
+	return &Options{
+		healthCheckInterval:  int(brgpu.DefaultHealthCheckInterval.Seconds()),
+		rediscoverInterval:   int(brgpu.DefaultRediscoverInterval.Seconds()),
+		sviPolicy:            string(brgpu.SVIPolicyPack),
+		allocationPolicy:     brgpu.PolicyTopologyBest,
+		mode:                 modePlugin,
+		runtime:              string(brgpu.RuntimeRunc),
+		exporterInterval:     int(brgpu.DefaultExporterInterval.Seconds()),
+		podResourcesSocket:   podresources.DefaultSocket,
+		podResourcesInterval: int(podresources.DefaultInterval.Seconds()),
+		nodeLabels:           true,
+		pluginMountPath:      brgpu.DefaultPluginMountPath,
+		deviceIDStrategy:     string(brgpu.DeviceIDIndex),
+	}
 }
 
 func (o *Options) AddFlags(fs *pflag.FlagSet) {
+	o.flags = fs
+	fs.StringVar(&o.configPath, "config", o.configPath, "versioned YAML or JSON config file, reloaded on change; flags given on the command line win over it, "+config.EnvFile+" names the file when the flag is not given")
+	fs.StringVar(&o.configMapRef, "config-map", o.configMapRef, "namespace/name of a ConfigMap holding config profiles, the node label "+config.ProfileLabel("<resource-namespace>")+", like "+config.ProfileLabel(brgpu.ResourceNaming.Namespace)+", selects the profile of the node named by NODE_NAME; a change of profile is applied live when it only changes allocation policies and mounts and restarts the container otherwise; the namespace defaults to POD_NAMESPACE")
+	fs.StringVar(&o.mode, "mode", o.mode, "plugin serves devices to kubelet, exporter only exports device telemetry, all does both")
+	fs.IntVar(&o.exporterInterval, "exporter-interval", o.exporterInterval, "sample device telemetry every seconds in exporter mode")
 	fs.IntVar(&o.pulse, "pulse", o.pulse, "heart beating every seconds")
-	fs.StringVar(&o.runtime, "container-runtime", o.runtime, "the container runtime;runc or kata, default is runc")
+	fs.StringVar(&o.runtime, "container-runtime", o.runtime, "the container runtime;runc or kata")
 	fs.BoolVar(&brgpu.CdiFeature, "cdi-feature", brgpu.CdiFeature, "enable cdi feature")
 	fs.BoolVar(&brgpu.OverwriteCdiConfig, "overwrite-cdi-config", brgpu.OverwriteCdiConfig, "overwrite cdi config")
-	fs.BoolVar(&brgpu.MountHostPath, "mount-host-path", brgpu.MountHostPath, "mount lib and bin folder in host to container, default is false")
+	fs.BoolVar(&brgpu.RemoveCdiConfig, "remove-cdi-config", brgpu.RemoveCdiConfig, "remove the generated cdi config on shutdown")
+	fs.BoolVar(&o.mountHostPath, "mount-host-path", o.mountHostPath, "mount lib and bin folder in host to container, default is false")
+	fs.StringVar(&o.pluginMountPath, "plugin-mount-path", o.pluginMountPath, "where the /usr of the host is mounted in the plugin container, and where --mount-host-path mounts the host lib and bin folders in containers")
+	fs.BoolVar(&o.mountAllDevice, "mount-all-device", o.mountAllDevice, "mount every card of the node in containers allocated any card, for management containers")
+	fs.BoolVar(&o.mountDriDevice, "mount-dri-device", o.mountDriDevice, "mount the /dev/dri render nodes of the allocated cards in containers")
+	fs.IntVar(&o.initModeTolerateLevel, "init-mode-tolerate-level", o.initModeTolerateLevel, "0 stops the plugin when brml fails to initialize, 1 retries brml initialization until it succeeds, 2 also retries the first device discovery")
+	fs.IntVar(&o.healthCheckInterval, "health-check-interval", o.healthCheckInterval, "probe device health every seconds, 0 disables periodic probing")
+	fs.IntVar(&o.rediscoverInterval, "rediscover-interval", o.rediscoverInterval, "rediscover devices every seconds to pick up hot-plug and SVI mode changes, 0 disables periodic rediscovery")
+	fs.StringVar(&o.sviPolicy, "svi-policy", o.sviPolicy, "how SVI instances are preferred for allocation; pack fills partially used cards first, spread uses the least used cards first")
+	fs.StringVar(&o.allocationPolicy, "allocation-policy", o.allocationPolicy, fmt.Sprintf("how devices are preferred for allocation; one of %s, pods can override it with the <resource-namespace>/allocation-policy annotation, like %s", strings.Join(brgpu.PolicyNames(), ", "), brgpu.PolicyAnnotation()))
+	fs.StringVar(&o.gpuPartitionSize, "gpu-partition-size", o.gpuPartitionSize, "svi mode applied to idle cards at startup; whole, 1-2 or 1-4, optionally followed by index=size entries for single cards like whole,0=1-4")
+	fs.StringVar(&o.deviceIDStrategy, "device-id-strategy", o.deviceIDStrategy, "how devices are named to kubelet and in CDI specs in runc mode; index names them card_N, which changes with reboots and SVI modes, uuid names them by their stable UUID")
+	fs.StringVar(&brgpu.ResourceNaming.Namespace, "resource-namespace", brgpu.ResourceNaming.Namespace, "namespace of the advertised resources")
+	fs.StringVar(&brgpu.ResourceNaming.Whole, "whole-resource-name", brgpu.ResourceNaming.Whole, "template of the resource of whole cards, like {model} for birentech.com/br104p; {gpu} is gpu and {model} the card model reported by BRML, only in runc mode")
+	fs.StringVar(&brgpu.ResourceNaming.Split, "split-resource-name", brgpu.ResourceNaming.Split, "template of the resource of SVI instances and VFs, like {gpu}-1of{parts} for birentech.com/gpu-1of4; {parts} is the number of parts the card is split into")
+	fs.BoolVar(&brgpu.ResourceNaming.Aliases, "resource-aliases", brgpu.ResourceNaming.Aliases, "advertise half of the cards of every renamed resource, rounded down, under the name gpu or 1-N-gpu used before the names were changed, so that existing pods keep matching while they migrate")
+	fs.StringVar(&o.replicas, "replicas", o.replicas, "advertise every device of the given resources several times so that containers time-slice them, like gpu=4,1-2-gpu=2; only in runc mode")
+	fs.BoolVar(&o.renameShared, "rename-shared-resources", o.renameShared, "advertise the resources shared with --replicas as <name>"+brgpu.SharedSuffix+", like gpu"+brgpu.SharedSuffix)
+	fs.StringVar(&o.gpuMemoryUnit, "gpu-memory-unit", o.gpuMemoryUnit, "serve whole cards as the gpu-memory resource in units of this size, like 1Gi, so that containers ask for a slice of the memory of one card; only in runc mode")
+	fs.StringVar(&o.metricsAddress, "metrics-address", o.metricsAddress, "address like :9400 to serve prometheus metrics on /metrics, empty disables metrics")
+	fs.StringVar(&o.podResourcesSocket, "pod-resources-socket", o.podResourcesSocket, "kubelet pod resources socket polled to name the pods holding devices in health events, logs and metrics and to serve /allocations, empty disables it")
+	fs.IntVar(&o.podResourcesInterval, "pod-resources-interval", o.podResourcesInterval, "list pod resources every seconds")
+	fs.BoolVar(&o.nodeLabels, "node-labels", o.nodeLabels, "publish <resource-namespace>/gpu.* labels, like "+brgpu.LabelPrefix()+"count, describing the cards on the node named by NODE_NAME")
+	fs.StringVar(&o.fakeBackend, "fake-backend", o.fakeBackend, "serve devices from the given fixture file instead of brml, for testing and demos")
 }
 
+// Run serves until SIGINT or SIGTERM, which is a normal exit, or until
+// serving fails.
 func (o *Options) Run() error {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	var gpuConfig brgpu.GPUConfig
-	bgm := brgpu.NewBrGPUManager(o.pluginMountPath, gpuConfig)
-
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	go func() {
-		sig := <-sigs
-		log.Infof("Get the signal %s", sig)
-		bgm.Stop <- true
+		select {
+		case sig := <-sigs:
+			log.Infof("Get the signal %s", sig)
+			cancel()
+		case <-ctx.Done():
+		}
 	}()
+	path := o.configFile()
+	base := o.config()
+	loaded := base
+	if path != "" {
+		cfg, err := config.Load(path, base)
+		if err != nil {
+			log.Errorf("invalid options %v", err)
+			return err
+		}
+		log.Infof("Using config %s", path)
+		loaded = cfg
+		o.setConfig(o.merge(cfg))
+	}
+	var client *utils.Client
+	if node := os.Getenv("NODE_NAME"); node != "" && utils.InCluster() {
+		c, err := utils.NewClient(true)
+		if err != nil {
+			log.Errorf("create kubernetes client failed %v, config profiles, pod allocation policies, node labels and events are ignored", err)
+		} else {
+			client = &c
+		}
+	}
+	// profiles are laid over the config file, which is no longer watched
+	var profiles chan config.Config
+	if o.configMapRef != "" {
+		namespace, name, err := o.configMap()
+		if err != nil {
+			log.Errorf("invalid options %v", err)
+			return err
+		}
+		if client == nil {
+			err := fmt.Errorf("config map %s/%s needs NODE_NAME and running in cluster", namespace, name)
+			log.Errorf("invalid options %v", err)
+			return err
+		}
+		profiles = make(chan config.Config, 1)
+		cfg, err := config.WatchProfile(ctx, *client, os.Getenv("NODE_NAME"), namespace, name, loaded, func(cfg config.Config) {
+			// keep only the latest profile
+			select {
+			case <-profiles:
+			default:
+			}
+			profiles <- cfg
+		})
+		if err != nil {
+			log.Errorf("invalid options %v", err)
+			return err
+		}
+		log.Infof("Using config map %s/%s", namespace, name)
+		o.setConfig(o.merge(cfg))
+	}
+	if err := o.config().Validate(); err != nil {
+		log.Errorf("invalid options %v", err)
+		return err
+	}
+	brgpu.PluginMountPath = o.pluginMountPath
+	brgpu.IDStrategy, _ = brgpu.ParseDeviceIDStrategy(o.deviceIDStrategy)
+	metricsAddress := o.metricsAddress
+	if o.mode != modePlugin && metricsAddress == "" {
+		metricsAddress = defaultMetricsAddress
+	}
+	gpuConfig := brgpu.GPUConfig{GPUPartitionSize: o.gpuPartitionSize}
+	sviPolicy, _ := brgpu.ParseSVIPolicy(o.sviPolicy)
+	policy, _ := brgpu.NewPolicy(o.allocationPolicy, sviPolicy)
+	backend := brgpu.NewBRMLBackend()
+	if o.fakeBackend != "" {
+		fb, err := brgpu.LoadFakeBackend(o.fakeBackend)
+		if err != nil {
+			log.Errorf("load fake backend failed %v", err)
+			return err
+		}
+		log.Infof("Using fake backend from %s", o.fakeBackend)
+		backend = fb
+	}
+	if o.mode == modeAll {
+		// the plugin and the exporter share BRML
+		backend = brgpu.ShareBackend(backend)
+	}
+	var pods *podresources.Tracker
+	if o.podResourcesSocket != "" {
+		// health events and logs name the holders of devices as well as
+		// metrics, so the tracker runs with metrics off too
+		pods = podresources.NewTracker(o.podResourcesSocket, time.Duration(o.podResourcesInterval)*time.Second)
+		pods.Namespace = brgpu.ResourceNaming.Namespace
+		if metricsAddress != "" {
+			metrics.Handle("/allocations", pods)
+		}
+		go pods.Run(ctx.Done())
+	}
+	if metricsAddress != "" {
+		go func() {
+			if err := metrics.Serve(metricsAddress); err != nil {
+				log.Errorf("serve metrics failed %v", err)
+			}
+		}()
+	}
+	bgm := brgpu.NewBrGPUManager(o.pluginMountPath, gpuConfig, backend)
+	bgm.HealthCheckInterval = time.Duration(o.healthCheckInterval) * time.Second
+	bgm.RediscoverInterval = time.Duration(o.rediscoverInterval) * time.Second
+	bgm.SVIPolicy = sviPolicy
+	bgm.Policy = policy
+	bgm.Pods = pods
+	bgm.MountHostPath = o.mountHostPath
+	bgm.InitTolerateLevel = o.initModeTolerateLevel
+	replicas, _ := brgpu.ParseReplicas(o.replicas)
+	memoryUnit, _ := brgpu.ParseMemoryUnit(o.gpuMemoryUnit)
+	bgm.Sharing = brgpu.Sharing{Replicas: replicas, Rename: o.renameShared, MemoryUnit: memoryUnit}
+	if client != nil {
+		node := os.Getenv("NODE_NAME")
+		nodePods := client.WatchNodePods(ctx.Done(), node)
+		bgm.PodPolicy = brgpu.NewPodPolicyLookup(nodePods)
+		bgm.Events = brgpu.NewEvents(*client, node, nodePods)
+		if o.nodeLabels {
+			bgm.Labeler = &brgpu.NodeLabeler{Client: *client, Node: node}
+		}
+	}
+	defer bgm.Events.Shutdown()
+
+	// restart is closed before cancel when a new config profile needs a
+	// restart
+	restart := make(chan struct{})
+	switch {
+	case profiles != nil:
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case cfg := <-profiles:
+					fields, err := o.reload(cfg, bgm)
+					if err != nil {
+						log.Errorf("Reloading the config profile failed %v, keeping the current config", err)
+						continue
+					}
+					if len(fields) > 0 {
+						// the container exits and kubelet restarts it with
+						// the new profile
+						log.Warnf("Changing %v of the config needs a restart, restarting", fields)
+						close(restart)
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+	case path != "":
+		go config.Watch(ctx, path, base, loaded, func(cfg config.Config) {
+			fields, err := o.reload(cfg, bgm)
+			if err != nil {
+				log.Errorf("Reloading the config failed %v, keeping the current config", err)
+				return
+			}
+			if len(fields) > 0 {
+				log.Warnf("Changing %v of the config needs a restart, keeping the current values", fields)
+			}
+		})
+	}
+
+	if o.mode != modePlugin {
+		exporter := &brgpu.Exporter{
+			Backend:  backend,
+			Interval: time.Duration(o.exporterInterval) * time.Second,
+			Pods:     pods,
+		}
+		if o.mode == modeExporter {
+			if err := runExporter(ctx, exporter); err != nil {
+				return err
+			}
+			return stopped(restart)
+		}
+		go func() {
+			if err := runExporter(ctx, exporter); err != nil {
+				log.Errorf("exporter stopped %v", err)
+			}
+		}()
+	}
+
+	if err := bgm.Serve(ctx, o.pulse, o.mountAllDevice, o.mountDriDevice, o.runtime); err != nil {
+		log.Errorf("serve devices failed %v", err)
+		return err
+	}
+	return stopped(restart)
+}
+
+// stopped reports the end of serving. Stopping to restart with a new config
+// profile is no failure, kubelet restarts the container either way.
+func stopped(restart <-chan struct{}) error {
+	select {
+	case <-restart:
+		log.Info("Biren GPU Device Plugin stopped to restart with the new config profile")
+		return nil
+	default:
+	}
+	log.Info("Biren GPU Device Plugin stopped")
+	return nil
+}
+
+// runExporter samples device telemetry until ctx is done.
+func runExporter(ctx context.Context, exporter *brgpu.Exporter) error {
+	if err := exporter.Backend.Init(); err != nil {
+		log.Errorf("brml init failed %v", err)
+		return err
+	}
+	defer exporter.Backend.Shutdown()
 
-	bgm.Serve(o.pulse, o.mountAllDevice, o.mountDriDevice, o.runtime)
+	exporter.Run(ctx.Done())
 	return nil
 }
 
@@ -69,8 +352,11 @@ func NewManagerCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:  "br-gpu-device-plugin",
 		Long: "Biren gpu device plugin",
-		Run: func(cmd *cobra.Command, args []string) {
-			opts.Run()
+		// Run logs its errors
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.Run()
 		},
 		Args: func(cmd *cobra.Command, args []string) error {
 			for _, arg := range args {
@@ -6,17 +6,17 @@ import (
 	"os/exec"
 	"strings"
 
-	"github.com/BirenTechnology/go-brml/brml"
 	"github.com/BirenTechnology/k8s-device-plugin/pkg/brgpu"
 	log "github.com/sirupsen/logrus"
 )
 
 func main() {
-	err := brml.Init()
+	backend := brgpu.NewBRMLBackend()
+	err := backend.Init()
 	if err != nil {
 		log.Errorf("brml init failed %v", err)
 	}
-	defer brml.Shutdown()
+	defer backend.Shutdown()
 
 	cardsFiles, err := os.ReadDir("/dev/biren")
 	if err != nil {
@@ -29,7 +29,7 @@ func main() {
 			cards = append(cards, f.Name())
 		}
 	}
-	devices, err := brgpu.DeviceDiscover()
+	devices, err := brgpu.DeviceDiscover(backend)
 	if err != nil {
 		log.Errorf("discover devices failed %v", err)
 		panic(err)
@@ -39,7 +39,7 @@ func main() {
 		fmt.Println(d.PhysicalNum, d.Instances)
 	}
 
-	_, err = brgpu.Device2Graph(cards)
+	_, err = brgpu.Device2Graph(backend, cards)
 	if err != nil {
 		log.Errorf("device %v to graph failed %v", cards, err)
 		panic(err)
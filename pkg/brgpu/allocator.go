@@ -14,16 +14,25 @@
 package brgpu
 
 import (
+	"bytes"
+	"fmt"
 	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/BirenTechnology/go-brml/brml"
 	"github.com/BirenTechnology/k8s-device-plugin/pkg/utils"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
-func Device2Graph(devices []string) (*utils.Graph, error) {
+func Device2Graph(backend DeviceBackend, devices []string) (*utils.Graph, error) {
 	res := &utils.Graph{}
+	physicals := physicalBusIDs(backend)
 	for _, v := range devices {
 		diIndex, err := cardID2Index(v)
 		if err != nil {
@@ -34,20 +43,21 @@ func Device2Graph(devices []string) (*utils.Graph, error) {
 			Name: cardIDFormat(diIndex),
 		}
 		res.AddNode(cNode)
-		di, err := brml.HandleByNodeID(diIndex)
+		di, err := backend.HandleByNodeID(diIndex)
 		if err != nil {
 			return nil, err
 		}
+		res.SetNodeAttr(cNode.Name, deviceAttr(backend, di, physicals))
 		for _, v2 := range devices {
 			djIndex, err := cardID2Index(v2)
 			if err != nil {
 				return nil, err
 			}
-			dj, err := brml.HandleByNodeID(djIndex)
+			dj, err := backend.HandleByNodeID(djIndex)
 			if err != nil {
 				return nil, err
 			}
-			ps, err := brml.P2PStatusV2(di, dj)
+			ps, err := backend.P2PStatusV2(di, dj)
 			if err != nil {
 				return nil, err
 			}
@@ -62,15 +72,270 @@ func Device2Graph(devices []string) (*utils.Graph, error) {
 	return res, nil
 }
 
+// physicalBusIDs maps the sysfs bus id of every physical card to its index.
+func physicalBusIDs(backend DeviceBackend) map[string]int {
+	res := map[string]int{}
+	count, err := backend.DeviceCount()
+	if err != nil {
+		log.Errorf("get device count err %v", err)
+		return res
+	}
+	for i := 0; i < count; i++ {
+		dev, err := backend.HandleByIndex(i)
+		if err != nil {
+			log.Errorf("get device %d err %v", i, err)
+			continue
+		}
+		pcie, err := backend.DevicePciInfo(dev)
+		if err != nil {
+			log.Errorf("get device %d pcie info err %v", i, err)
+			continue
+		}
+		res[sysfsBusID(pcie)] = i
+	}
+	return res
+}
+
+// deviceAttr collects the NUMA node, PCIe position and physical card of a
+// card or SVI instance. Unknown values are left at their defaults.
+func deviceAttr(backend DeviceBackend, dev DeviceHandle, physicals map[string]int) utils.NodeAttr {
+	attr := utils.NodeAttr{NUMA: -1, Physical: -1}
+	pcie, err := backend.DevicePciInfo(dev)
+	if err != nil {
+		log.Errorf("get device %v pcie info err %v", dev, err)
+		return attr
+	}
+	busID := sysfsBusID(pcie)
+	if i, ok := physicals[busID]; ok {
+		attr.Physical = i
+	}
+	if hasNuma, numa, err := numaNode(basePath, busID); err == nil && hasNuma {
+		attr.NUMA = numa
+	}
+	attr.RootComplex, attr.Switch, err = pciLocality(basePath, busID)
+	if err != nil {
+		log.Debugf("get pcie locality of %s err %v", busID, err)
+	}
+	return attr
+}
+
+// sysfsBusID turns the bus id reported by BRML, which may carry an 8 digit
+// PCI domain, into the name used below /sys/bus/pci/devices.
+func sysfsBusID(pcie brml.PciInfo) string {
+	busID := strings.ToLower(int8Slice(pcie.BusId[:]).String())
+	if strings.Index(busID, ":") == 8 {
+		busID = busID[4:]
+	}
+	return busID
+}
+
+func numaNode(pciRoot string, busID string) (bool, int, error) {
+	b, err := os.ReadFile(filepath.Join(pciRoot, busID, "numa_node"))
+	if err != nil {
+		// VMs and some platforms do not expose the NUMA node
+		log.Debugf("read bus file id %v fail %v ", busID, err)
+		return false, 0, nil
+	}
+
+	node, err := strconv.Atoi(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return false, 0, fmt.Errorf("eror parsing value for NUMA node: %v", err)
+	}
+
+	if node < 0 {
+		return false, 0, nil
+	}
+
+	return true, node, nil
+}
+
+// pciLocality resolves the sysfs path of a PCI device, like
+// /sys/devices/pci0000:00/0000:00:01.0/0000:01:00.0/0000:02:08.0/0000:03:00.0,
+// and returns its root bus and the upstream port of the first switch below
+// the root port, or the root port itself when no switch is in between.
+func pciLocality(pciRoot string, busID string) (string, string, error) {
+	p, err := filepath.EvalSymlinks(filepath.Join(pciRoot, busID))
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(filepath.ToSlash(p), "/")
+	root := -1
+	for i, part := range parts {
+		if strings.HasPrefix(part, "pci") {
+			root = i
+			break
+		}
+	}
+	if root < 0 {
+		return "", "", fmt.Errorf("no pci root in %s", p)
+	}
+	// root bus, root port, switch upstream port, switch downstream port, device
+	chain := parts[root:]
+	switch {
+	case len(chain) >= 5:
+		return chain[0], chain[2], nil
+	case len(chain) >= 3:
+		return chain[0], chain[1], nil
+	}
+	return chain[0], "", nil
+}
+
 func scoreEnlarge(num int) int {
 	return int(math.Pow(float64(num)+1, 2))
 }
 
+// SVIPolicy decides which SVI instances a request gets when cards are split.
+type SVIPolicy string
+
+const (
+	// SVIPolicyPack fills partially used cards first so that whole cards stay
+	// free for large jobs.
+	SVIPolicyPack SVIPolicy = "pack"
+	// SVIPolicySpread hands out instances of the least used cards first so that
+	// workloads share a card as little as possible.
+	SVIPolicySpread SVIPolicy = "spread"
+)
+
+func ParseSVIPolicy(s string) (SVIPolicy, error) {
+	switch SVIPolicy(s) {
+	case SVIPolicyPack, SVIPolicySpread:
+		return SVIPolicy(s), nil
+	case "":
+		return SVIPolicyPack, nil
+	}
+	return "", fmt.Errorf("unknown svi policy %q, use %s or %s", s, SVIPolicyPack, SVIPolicySpread)
+}
+
+// sviOrder sorts the available SVI instances in the order policy prefers
+// them, using the physical card they belong to. A card counts as used when
+// some of its instances are not available. It reports false when none of the
+// available devices is an SVI instance.
+func sviOrder(gpus DevicesInfoList, policy SVIPolicy, available []string) ([]string, bool) {
+	physical := map[string]int{}
+	total := map[int]int{}
+	for _, d := range gpus {
+		if d.SVICount <= 1 {
+			continue
+		}
+		for _, ins := range d.Instances {
+			physical[ins.CardID] = d.PhysicalNum
+		}
+		total[d.PhysicalNum] = len(d.Instances)
+	}
+
+	free := map[int][]string{}
+	cards := []int{}
+	rest := []string{}
+	for _, id := range available {
+		p, ok := physical[id]
+		if !ok {
+			rest = append(rest, id)
+			continue
+		}
+		if _, ok := free[p]; !ok {
+			cards = append(cards, p)
+		}
+		free[p] = append(free[p], id)
+	}
+	if len(cards) == 0 {
+		return available, false
+	}
+
+	sort.SliceStable(cards, func(a, b int) bool {
+		fa, fb := len(free[cards[a]]), len(free[cards[b]])
+		ua, ub := total[cards[a]]-fa, total[cards[b]]-fb
+		if policy == SVIPolicySpread {
+			if ua != ub {
+				return ua < ub
+			}
+			return fa > fb
+		}
+		if (ua > 0) != (ub > 0) {
+			return ua > 0
+		}
+		return fa < fb
+	})
+
+	res := []string{}
+	if policy == SVIPolicySpread {
+		for round := 0; len(res) < len(available)-len(rest); round++ {
+			for _, p := range cards {
+				if round < len(free[p]) {
+					res = append(res, free[p][round])
+				}
+			}
+		}
+	} else {
+		for _, p := range cards {
+			res = append(res, free[p]...)
+		}
+	}
+	return append(res, rest...), true
+}
+
 func Allocate(g utils.Graph, mustIncludeNodes []string, size int) []string {
-	_, names := g.MaxValCount(size)
-	if len(mustIncludeNodes) != 0 {
-		log.Error("must include nodes not nil")
+	_, names := g.BestSetWith(mustIncludeNodes, size)
+	log.Infof("Select devices: %v", names)
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.Debugf("Selected from topo: \n%s", g.String())
 	}
-	log.Infof("Select devices: %v from topo: %v", names, g.String())
 	return names
 }
+
+// AllocateContainers picks devices for every container request of a
+// preferred allocation call so that no device is handed to two containers.
+// Larger requests are served first since they have fewer good choices.
+func AllocateContainers(policy Policy, topo AllocationTopology, reqs []*pluginapi.ContainerPreferredAllocationRequest) [][]string {
+	res := make([][]string, len(reqs))
+	order := make([]int, len(reqs))
+	reserved := map[string]int{}
+	for i, req := range reqs {
+		order[i] = i
+		for _, id := range req.MustIncludeDeviceIDs {
+			reserved[id] = i
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return reqs[order[a]].AllocationSize > reqs[order[b]].AllocationSize
+	})
+
+	taken := map[string]bool{}
+	for _, i := range order {
+		req := reqs[i]
+		available := []string{}
+		for _, id := range req.AvailableDeviceIDs {
+			if owner, ok := reserved[id]; taken[id] || (ok && owner != i) {
+				continue
+			}
+			available = append(available, id)
+		}
+		must := []string{}
+		for _, id := range req.MustIncludeDeviceIDs {
+			if !taken[id] {
+				must = append(must, id)
+			}
+		}
+
+		size := int(req.AllocationSize)
+		devices := policy.Select(topo, available, must, size)
+		for _, id := range devices {
+			taken[id] = true
+		}
+		res[i] = devices
+	}
+	return res
+}
+
+// firstFit returns the must devices followed by the first available ones.
+func firstFit(available []string, must []string, size int) []string {
+	res := append([]string{}, must...)
+	for _, id := range available {
+		if len(res) >= size {
+			break
+		}
+		if !containString(res, id) {
+			res = append(res, id)
+		}
+	}
+	return res
+}
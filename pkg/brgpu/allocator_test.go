@@ -0,0 +1,321 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BirenTechnology/go-brml/brml"
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// matrixGraph builds a graph from a matrix like the ones in
+// pkg/utils/topo_test.go, using the P2P link names of the hardware.
+func matrixGraph(s string) *utils.Graph {
+	vals := map[string]int{
+		"direct":   scoreEnlarge(2),
+		"indirect": scoreEnlarge(1),
+		"none":     scoreEnlarge(0),
+	}
+	g := &utils.Graph{}
+	lines := []string{}
+	for _, l := range strings.Split(s, "\n") {
+		if strings.TrimSpace(l) != "" {
+			lines = append(lines, l)
+		}
+	}
+	nodes := []*utils.Node{}
+	for _, name := range strings.Fields(lines[0]) {
+		n := &utils.Node{Name: name}
+		nodes = append(nodes, n)
+		g.AddNode(n)
+	}
+	for i, l := range lines[1:] {
+		for j, c := range strings.Fields(l)[1:] {
+			if v, ok := vals[c]; ok {
+				g.AddEdge(nodes[i], nodes[j], v)
+			}
+		}
+	}
+	return g
+}
+
+// twoGroupsMatrix has two groups of directly linked cards, card_0..card_3
+// and card_4..card_7.
+const twoGroupsMatrix = `
+       card_0   card_1   card_2   card_3   card_4   card_5   card_6   card_7
+card_0 x        direct   direct   direct   none     none     none     none
+card_1 direct   x        direct   direct   none     none     none     none
+card_2 direct   direct   x        direct   none     none     none     none
+card_3 direct   direct   direct   x        none     none     none     none
+card_4 none     none     none     none     x        direct   direct   direct
+card_5 none     none     none     none     direct   x        direct   direct
+card_6 none     none     none     none     direct   direct   x        direct
+card_7 none     none     none     none     direct   direct   direct   x
+`
+
+func TestAllocateMustInclude(t *testing.T) {
+	twoGroups := matrixGraph(twoGroupsMatrix)
+	chain := matrixGraph(`
+       card_0   card_1   card_2   card_3
+card_0 x        direct   indirect none
+card_1 direct   x        direct   indirect
+card_2 indirect direct   x        direct
+card_3 none     indirect direct   x
+`)
+
+	cases := []struct {
+		name string
+		g    *utils.Graph
+		must []string
+		size int
+		want []string
+	}{
+		{"no must include", twoGroups, nil, 2, []string{"card_0", "card_1"}},
+		{"must include picks its group", twoGroups, []string{"card_5"}, 2, []string{"card_4", "card_5"}},
+		{"must include fills its group", twoGroups, []string{"card_6"}, 4, []string{"card_4", "card_5", "card_6", "card_7"}},
+		{"must include across groups", twoGroups, []string{"card_0", "card_7"}, 3, []string{"card_0", "card_1", "card_7"}},
+		{"must include equals size", twoGroups, []string{"card_2", "card_6"}, 2, []string{"card_2", "card_6"}},
+		{"must include at chain end", chain, []string{"card_3"}, 2, []string{"card_2", "card_3"}},
+		{"must include in chain middle", chain, []string{"card_1"}, 3, []string{"card_0", "card_1", "card_2"}},
+		{"must include both ends ties to lower card", chain, []string{"card_0", "card_3"}, 3, []string{"card_0", "card_1", "card_3"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := Allocate(*c.g, c.must, c.size)
+			assert.ElementsMatch(t, c.want, got)
+		})
+	}
+}
+
+func TestAllocateContainers(t *testing.T) {
+	twoGroups := matrixGraph(twoGroupsMatrix)
+	all := []string{"card_0", "card_1", "card_2", "card_3", "card_4", "card_5", "card_6", "card_7"}
+	req := func(size int32, must ...string) *pluginapi.ContainerPreferredAllocationRequest {
+		return &pluginapi.ContainerPreferredAllocationRequest{
+			AvailableDeviceIDs:   all,
+			MustIncludeDeviceIDs: must,
+			AllocationSize:       size,
+		}
+	}
+
+	cases := []struct {
+		name string
+		g    *utils.Graph
+		reqs []*pluginapi.ContainerPreferredAllocationRequest
+		want [][]string
+	}{
+		{"no containers", twoGroups, nil, [][]string{}},
+		{
+			"one container per group",
+			twoGroups,
+			[]*pluginapi.ContainerPreferredAllocationRequest{req(4), req(4)},
+			[][]string{{"card_0", "card_1", "card_2", "card_3"}, {"card_4", "card_5", "card_6", "card_7"}},
+		},
+		{
+			"larger request served first",
+			twoGroups,
+			[]*pluginapi.ContainerPreferredAllocationRequest{req(2), req(4)},
+			[][]string{{"card_4", "card_5"}, {"card_0", "card_1", "card_2", "card_3"}},
+		},
+		{
+			"must include is reserved for its container",
+			twoGroups,
+			[]*pluginapi.ContainerPreferredAllocationRequest{req(4), req(2, "card_1")},
+			[][]string{{"card_4", "card_5", "card_6", "card_7"}, {"card_0", "card_1"}},
+		},
+		{
+			"not enough devices left",
+			twoGroups,
+			[]*pluginapi.ContainerPreferredAllocationRequest{req(6), req(4)},
+			[][]string{{"card_0", "card_1", "card_2", "card_3", "card_4", "card_5"}, {"card_6", "card_7"}},
+		},
+		{
+			"unknown topology",
+			nil,
+			[]*pluginapi.ContainerPreferredAllocationRequest{req(1), req(2, "card_5")},
+			[][]string{{"card_1"}, {"card_5", "card_0"}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := AllocateContainers(topologyBest{svi: SVIPolicyPack}, AllocationTopology{Graph: c.g}, c.reqs)
+			assert.Len(t, got, len(c.want))
+			for i := range c.want {
+				assert.ElementsMatch(t, c.want[i], got[i], "container %d", i)
+			}
+		})
+	}
+}
+
+func TestSVIPolicy(t *testing.T) {
+	gpus := DevicesInfoList{}
+	for p := 0; p < 3; p++ {
+		d := DevicesInfo{PhysicalNum: p, SVICount: 4}
+		for i := 0; i < 4; i++ {
+			d.Instances = append(d.Instances, Instance{CardID: cardIDFormat(p*4 + i), ResourceName: "1-4-gpu"})
+		}
+		gpus = append(gpus, d)
+	}
+	// Card 0 has two instances in use, card 2 one, card 1 none.
+	available := []string{"card_1", "card_2", "card_4", "card_5", "card_6", "card_7", "card_9", "card_10", "card_11"}
+	req := func(size int32, must ...string) *pluginapi.ContainerPreferredAllocationRequest {
+		return &pluginapi.ContainerPreferredAllocationRequest{
+			AvailableDeviceIDs:   available,
+			MustIncludeDeviceIDs: must,
+			AllocationSize:       size,
+		}
+	}
+
+	cases := []struct {
+		name   string
+		policy SVIPolicy
+		reqs   []*pluginapi.ContainerPreferredAllocationRequest
+		want   [][]string
+	}{
+		{"pack fills the most used card", SVIPolicyPack, []*pluginapi.ContainerPreferredAllocationRequest{req(1)}, [][]string{{"card_1"}}},
+		{"pack keeps whole cards free", SVIPolicyPack, []*pluginapi.ContainerPreferredAllocationRequest{req(4)}, [][]string{{"card_1", "card_2", "card_9", "card_10"}}},
+		{"pack across containers", SVIPolicyPack, []*pluginapi.ContainerPreferredAllocationRequest{req(1), req(2)}, [][]string{{"card_9"}, {"card_1", "card_2"}}},
+		{"pack with must include", SVIPolicyPack, []*pluginapi.ContainerPreferredAllocationRequest{req(2, "card_5")}, [][]string{{"card_5", "card_1"}}},
+		{"spread uses the free card", SVIPolicySpread, []*pluginapi.ContainerPreferredAllocationRequest{req(1)}, [][]string{{"card_4"}}},
+		{"spread across cards", SVIPolicySpread, []*pluginapi.ContainerPreferredAllocationRequest{req(3)}, [][]string{{"card_4", "card_9", "card_1"}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := AllocateContainers(topologyBest{svi: c.policy}, AllocationTopology{GPUs: gpus}, c.reqs)
+			assert.Equal(t, c.want, got)
+		})
+	}
+
+	_, err := ParseSVIPolicy("fill")
+	assert.Error(t, err)
+	policy, err := ParseSVIPolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, SVIPolicyPack, policy)
+}
+
+func TestGetPreferredAllocationEmpty(t *testing.T) {
+	p := &Plugin{}
+	res, err := p.GetPreferredAllocation(nil, &pluginapi.PreferredAllocationRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, res.ContainerResponses, 0)
+}
+
+// newLargeBackend returns n whole cards with random P2P links between them.
+func newLargeBackend(n int) *FakeBackend {
+	r := rand.New(rand.NewSource(1))
+	fb := &FakeBackend{BRMLVersion: "1.0.0", P2P: make([][]uint32, n)}
+	for i := 0; i < n; i++ {
+		fb.Devices = append(fb.Devices, FakeDevice{UUID: fmt.Sprintf("GPU-%d", i), NodeID: i, Memory: 64 << 30, SviMode: 1})
+		fb.P2P[i] = make([]uint32, n)
+	}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			link := uint32(r.Intn(3))
+			fb.P2P[i][j], fb.P2P[j][i] = link, link
+		}
+	}
+	return fb
+}
+
+func BenchmarkGetPreferredAllocation64(b *testing.B) {
+	backend := newLargeBackend(64)
+	info, err := DeviceDiscover(backend)
+	if err != nil {
+		b.Fatal(err)
+	}
+	p := &Plugin{
+		Runtime:      string(RuntimeRunc),
+		Backend:      backend,
+		BRGPUs:       info,
+		Policy:       topologyBest{svi: SVIPolicyPack},
+		resourceName: "gpu",
+	}
+	// ListAndWatch builds the topology once per device list
+	p.apiDevices()
+	available := info.AllCardIDs()
+	for _, size := range []int{2, 4, 8, 16, 32} {
+		req := &pluginapi.PreferredAllocationRequest{ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+			AvailableDeviceIDs: available,
+			AllocationSize:     int32(size),
+		}}}
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				res, err := p.GetPreferredAllocation(context.Background(), req)
+				if err != nil || len(res.ContainerResponses[0].DeviceIDs) != size {
+					b.Fatalf("preferred %v, %v", res, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSysfsBusID(t *testing.T) {
+	pcie := func(busID string) brml.PciInfo {
+		info := brml.PciInfo{}
+		for i := 0; i < len(busID); i++ {
+			info.BusId[i] = int8(busID[i])
+		}
+		return info
+	}
+	assert.Equal(t, "0000:3d:00.0", sysfsBusID(pcie("00000000:3D:00.0")))
+	assert.Equal(t, "0000:3d:00.0", sysfsBusID(pcie("0000:3d:00.0")))
+}
+
+func TestPCILocality(t *testing.T) {
+	root := t.TempDir()
+	pciRoot := filepath.Join(root, "bus", "pci", "devices")
+	devices := map[string]string{
+		// behind a PCIe switch
+		"0000:03:00.0": "pci0000:00/0000:00:01.0/0000:01:00.0/0000:02:08.0/0000:03:00.0",
+		// directly below the root port
+		"0000:81:00.0": "pci0000:80/0000:80:03.0/0000:81:00.0",
+	}
+	assert.NoError(t, os.MkdirAll(pciRoot, 0755))
+	for busID, p := range devices {
+		dir := filepath.Join(root, "devices", p)
+		assert.NoError(t, os.MkdirAll(dir, 0755))
+		assert.NoError(t, os.Symlink(dir, filepath.Join(pciRoot, busID)))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(pciRoot, "0000:03:00.0", "numa_node"), []byte("1\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(pciRoot, "0000:81:00.0", "numa_node"), []byte("-1\n"), 0644))
+
+	rc, sw, err := pciLocality(pciRoot, "0000:03:00.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "pci0000:00", rc)
+	assert.Equal(t, "0000:01:00.0", sw)
+	hasNuma, numa, err := numaNode(pciRoot, "0000:03:00.0")
+	assert.NoError(t, err)
+	assert.True(t, hasNuma)
+	assert.Equal(t, 1, numa)
+
+	rc, sw, err = pciLocality(pciRoot, "0000:81:00.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "pci0000:80", rc)
+	assert.Equal(t, "0000:80:03.0", sw)
+	hasNuma, _, err = numaNode(pciRoot, "0000:81:00.0")
+	assert.NoError(t, err)
+	assert.False(t, hasNuma)
+
+	_, _, err = pciLocality(pciRoot, "0000:99:00.0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,293 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/BirenTechnology/go-brml/brml"
+)
+
+// DeviceHandle identifies a physical card or an SVI instance inside a
+// DeviceBackend. Its concrete type is private to the backend that returned it.
+type DeviceHandle interface{}
+
+// DeviceBackend is the set of management library calls the plugin relies on.
+// The production implementation wraps go-brml, FakeBackend serves fixtures so
+// the plugin can run on machines without Biren cards.
+type DeviceBackend interface {
+	Init() error
+	Shutdown() error
+	Version() (string, error)
+
+	DeviceCount() (int, error)
+	HandleByIndex(index int) (DeviceHandle, error)
+	HandleByNodeID(id int) (DeviceHandle, error)
+	GetSviMode(device DeviceHandle) (int, error)
+	GetGPUInstanceByID(device DeviceHandle, id uint32) (DeviceHandle, error)
+	MemoryInfo(device DeviceHandle) (brml.Memory, error)
+	DeviceUUID(device DeviceHandle) (string, error)
+	// ProductName returns the model of the card, like BR104P.
+	ProductName(device DeviceHandle) (string, error)
+	DevicePciInfo(device DeviceHandle) (brml.PciInfo, error)
+	GetGPUNodeIds(device DeviceHandle) (int, error)
+	P2PStatusV2(device DeviceHandle, device2 DeviceHandle) (brml.P2pStatus, error)
+	HealthStatus(device DeviceHandle) (brml.GpuHealthStatus, error)
+	// ErrorCounters returns the uncorrected ECC and fatal AER error totals.
+	ErrorCounters(device DeviceHandle) (uint64, uint64, error)
+	RunningProcesses(device DeviceHandle) (int, error)
+	UtilizationRates(device DeviceHandle) (brml.Utilization, error)
+	// Temperature returns the GPU temperature in degrees Celsius.
+	Temperature(device DeviceHandle) (int, error)
+	// PowerUsage returns the power draw in milliwatts.
+	PowerUsage(device DeviceHandle) (int, error)
+	// SetSviMode splits a card into mode SVI instances, mode 1 makes it whole.
+	SetSviMode(device DeviceHandle, mode int) error
+}
+
+// ErrInstanceNotFound is returned for SVI instances a card does not report,
+// like while it is being split.
+var ErrInstanceNotFound = errors.New("svi instance not found")
+
+// sharedBackend lets several users initialize one backend, it is shut down
+// when the last of them is done.
+type sharedBackend struct {
+	DeviceBackend
+
+	mu   sync.Mutex
+	refs int
+}
+
+// ShareBackend returns backend for users that each call Init and Shutdown,
+// like the plugin and the exporter running in one process.
+func ShareBackend(backend DeviceBackend) DeviceBackend {
+	return &sharedBackend{DeviceBackend: backend}
+}
+
+func (b *sharedBackend) Init() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.refs == 0 {
+		if err := b.DeviceBackend.Init(); err != nil {
+			return err
+		}
+	}
+	b.refs++
+	return nil
+}
+
+func (b *sharedBackend) Shutdown() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.refs == 0 {
+		return nil
+	}
+	b.refs--
+	if b.refs > 0 {
+		return nil
+	}
+	return b.DeviceBackend.Shutdown()
+}
+
+type brmlBackend struct{}
+
+// NewBRMLBackend returns the DeviceBackend backed by libbiren-ml.
+func NewBRMLBackend() DeviceBackend {
+	return brmlBackend{}
+}
+
+func (brmlBackend) Init() error {
+	return brml.Init()
+}
+
+func (brmlBackend) Shutdown() error {
+	return brml.Shutdown()
+}
+
+func (brmlBackend) Version() (string, error) {
+	return brml.BRMLVersion()
+}
+
+func (brmlBackend) DeviceCount() (int, error) {
+	return brml.DeviceCount()
+}
+
+func (brmlBackend) HandleByIndex(index int) (DeviceHandle, error) {
+	return brml.HandleByIndex(index)
+}
+
+func (brmlBackend) HandleByNodeID(id int) (DeviceHandle, error) {
+	return brml.HandleByNodeID(id)
+}
+
+func (b brmlBackend) GetSviMode(device DeviceHandle) (int, error) {
+	d, err := b.device(device)
+	if err != nil {
+		return 0, err
+	}
+	return brml.GetSviMode(d)
+}
+
+func (b brmlBackend) GetGPUInstanceByID(device DeviceHandle, id uint32) (DeviceHandle, error) {
+	d, err := b.device(device)
+	if err != nil {
+		return nil, err
+	}
+	ins, err := brml.GetGPUInstanceByID(d, id)
+	if err != nil && err.Error() == brml.Error2String(brml.ERROR_NOT_FOUND) {
+		return nil, fmt.Errorf("%w: %v", ErrInstanceNotFound, err)
+	}
+	return ins, err
+}
+
+func (b brmlBackend) MemoryInfo(device DeviceHandle) (brml.Memory, error) {
+	d, err := b.device(device)
+	if err != nil {
+		return brml.Memory{}, err
+	}
+	return brml.MemoryInfo(d)
+}
+
+func (b brmlBackend) DeviceUUID(device DeviceHandle) (string, error) {
+	d, err := b.device(device)
+	if err != nil {
+		return "", err
+	}
+	return brml.DeviceUUID(d)
+}
+
+func (b brmlBackend) ProductName(device DeviceHandle) (string, error) {
+	d, err := b.device(device)
+	if err != nil {
+		return "", err
+	}
+	info, err := brml.GetGPUInfo(d)
+	if err != nil {
+		return "", err
+	}
+	name := []byte{}
+	for _, c := range info.Name {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	return string(name), nil
+}
+
+func (b brmlBackend) DevicePciInfo(device DeviceHandle) (brml.PciInfo, error) {
+	d, err := b.device(device)
+	if err != nil {
+		return brml.PciInfo{}, err
+	}
+	return brml.DevicePciInfo(d)
+}
+
+func (b brmlBackend) GetGPUNodeIds(device DeviceHandle) (int, error) {
+	d, err := b.device(device)
+	if err != nil {
+		return 0, err
+	}
+	return brml.GetGPUNodeIds(d)
+}
+
+func (b brmlBackend) P2PStatusV2(device DeviceHandle, device2 DeviceHandle) (brml.P2pStatus, error) {
+	d1, err := b.device(device)
+	if err != nil {
+		return brml.P2pStatus{}, err
+	}
+	d2, err := b.device(device2)
+	if err != nil {
+		return brml.P2pStatus{}, err
+	}
+	return brml.P2PStatusV2(d1, d2)
+}
+
+func (b brmlBackend) HealthStatus(device DeviceHandle) (brml.GpuHealthStatus, error) {
+	d, err := b.device(device)
+	if err != nil {
+		return 0, err
+	}
+	return brml.HealthStatus(d)
+}
+
+func (b brmlBackend) ErrorCounters(device DeviceHandle) (uint64, uint64, error) {
+	d, err := b.device(device)
+	if err != nil {
+		return 0, 0, err
+	}
+	ecc, err := brml.TotalEccErrors(d, brml.MEMORY_ERROR_TYPE_UNCORRECTED, brml.VOLATILE_ECC)
+	if err != nil {
+		return 0, 0, err
+	}
+	aer, err := brml.TotalAerErrors(d, brml.AER_ERROR_TYPE_FATAL)
+	if err != nil {
+		return 0, 0, err
+	}
+	return ecc, aer, nil
+}
+
+func (b brmlBackend) RunningProcesses(device DeviceHandle) (int, error) {
+	d, err := b.device(device)
+	if err != nil {
+		return 0, err
+	}
+	count, _, err := brml.ComputeRunningProcess(d)
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+func (b brmlBackend) UtilizationRates(device DeviceHandle) (brml.Utilization, error) {
+	d, err := b.device(device)
+	if err != nil {
+		return brml.Utilization{}, err
+	}
+	return brml.UtilizationRates(d)
+}
+
+func (b brmlBackend) Temperature(device DeviceHandle) (int, error) {
+	d, err := b.device(device)
+	if err != nil {
+		return 0, err
+	}
+	return brml.Temperature(d, brml.TEMPERATURE_GPU)
+}
+
+func (b brmlBackend) PowerUsage(device DeviceHandle) (int, error) {
+	d, err := b.device(device)
+	if err != nil {
+		return 0, err
+	}
+	return brml.PowerUsage(d)
+}
+
+func (b brmlBackend) SetSviMode(device DeviceHandle, mode int) error {
+	d, err := b.device(device)
+	if err != nil {
+		return err
+	}
+	return setSviMode(d, mode)
+}
+
+func (brmlBackend) device(h DeviceHandle) (brml.Device, error) {
+	d, ok := h.(brml.Device)
+	if !ok {
+		return nil, fmt.Errorf("handle %v is not a brml device", h)
+	}
+	return d, nil
+}
@@ -19,7 +19,7 @@ import (
 	"os"
 	"path"
 
-	"github.com/BirenTechnology/go-brml/brml"
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/metrics"
 	log "github.com/sirupsen/logrus"
 	"sigs.k8s.io/yaml"
 	cdi "tags.cncf.io/container-device-interface/specs-go"
@@ -35,21 +35,32 @@ const (
 var (
 	CdiFeature         bool
 	OverwriteCdiConfig bool
+	// RemoveCdiConfig removes the generated CDI spec on shutdown.
+	RemoveCdiConfig bool
 )
 
-func cdiSPec(runtime ContainerRuntime) ([]*cdi.Spec, error) {
+func cdiSPec(backend DeviceBackend, runtime ContainerRuntime, mountDriDevice bool, mountHostPath bool) ([]*cdi.Spec, error) {
 	switch runtime {
 	case RuntimeRunc:
-		return runcCDI()
+		if !mountDriDevice {
+			return runcCDI(backend, nil, mountHostPath)
+		}
+		dri, err := findRenderNodes(sysClassDrm)
+		if err != nil {
+			return nil, err
+		}
+		return runcCDI(backend, &dri, mountHostPath)
 	case RuntimeKata:
-		return kataCDI()
+		return kataCDI(backend, mountHostPath)
 	}
 
 	return nil, nil
 }
 
-func runcCDI() ([]*cdi.Spec, error) {
-	info, err := DeviceDiscover()
+// runcCDI returns a spec per resource, the devices carry their render nodes
+// when dri is given.
+func runcCDI(backend DeviceBackend, dri *renderNodes, mountHostPath bool) ([]*cdi.Spec, error) {
+	info, err := DeviceDiscover(backend)
 	if err != nil {
 		log.Errorf("deviceDiscover error: %v", err)
 		return nil, err
@@ -69,23 +80,37 @@ func runcCDI() ([]*cdi.Spec, error) {
 	}
 
 	for k, vs := range resourceInstances {
-		spec := genSpec(k, MountHostPath)
+		spec := genSpec(backend, k, mountHostPath)
 		for _, v := range vs {
+			nodes := []*cdi.DeviceNode{
+				{
+					Path:        path.Join(deviceBasePath, v.CardID),
+					HostPath:    path.Join(deviceBasePath, v.CardID),
+					Type:        "c",
+					Permissions: "rw",
+				},
+			}
+			if dri != nil {
+				renderNode, err := dri.path(backend, v.CardID)
+				if err != nil {
+					log.Errorf("find render node of %s failed %v", v.CardID, err)
+					return nil, err
+				}
+				nodes = append(nodes, &cdi.DeviceNode{
+					Path:        renderNode,
+					HostPath:    renderNode,
+					Type:        "c",
+					Permissions: "rw",
+				})
+			}
 			spec.Devices = append(spec.Devices, cdi.Device{
-				Name:        v.CardID,
+				Name:        v.deviceID(),
 				Annotations: map[string]string{},
 				ContainerEdits: cdi.ContainerEdits{
-					Env: []string{},
-					DeviceNodes: []*cdi.DeviceNode{
-						{
-							Path:        path.Join(deviceBasePath, v.CardID),
-							HostPath:    path.Join(deviceBasePath, v.CardID),
-							Type:        "c",
-							Permissions: "rw",
-						},
-					},
-					Hooks:  []*cdi.Hook{},
-					Mounts: []*cdi.Mount{},
+					Env:         []string{},
+					DeviceNodes: nodes,
+					Hooks:       []*cdi.Hook{},
+					Mounts:      []*cdi.Mount{},
 				},
 			})
 		}
@@ -95,7 +120,7 @@ func runcCDI() ([]*cdi.Spec, error) {
 	return specs, nil
 }
 
-func kataCDI() ([]*cdi.Spec, error) {
+func kataCDI(backend DeviceBackend, mountHostPath bool) ([]*cdi.Spec, error) {
 	info, err := vfDeviceDiscover()
 	if err != nil {
 		log.Errorf("vfDeviceDiscover error: %v", err)
@@ -114,7 +139,7 @@ func kataCDI() ([]*cdi.Spec, error) {
 	}
 
 	for k, vs := range resourceVFDeviceInfos {
-		spec := genSpec(k, MountHostPath)
+		spec := genSpec(backend, k, mountHostPath)
 		for _, v := range vs {
 			spec.Devices = append(spec.Devices, cdi.Device{
 				Name:        v.deviceEndpoint(),
@@ -137,10 +162,10 @@ func kataCDI() ([]*cdi.Spec, error) {
 	return specs, nil
 }
 
-func genSpec(resource string, mountHostPath bool) *cdi.Spec {
+func genSpec(backend DeviceBackend, resource string, mountHostPath bool) *cdi.Spec {
 	spec := &cdi.Spec{
 		Version:     cdiVersion,
-		Kind:        fmt.Sprintf("%s/%s", vendor, resource),
+		Kind:        fmt.Sprintf("%s/%s", ResourceNaming.Namespace, resource),
 		Annotations: map[string]string{},
 		Devices:     []cdi.Device{},
 		ContainerEdits: cdi.ContainerEdits{
@@ -152,7 +177,7 @@ func genSpec(resource string, mountHostPath bool) *cdi.Spec {
 	}
 	if mountHostPath {
 		cdiMounts := []*cdi.Mount{}
-		brmlVersion, _ := brml.BRMLVersion()
+		brmlVersion, _ := backend.Version()
 		mountPaths := map[string]func(string) string{
 			"/usr/lib/libbiren-ml.so":                              defaultMountPathFunc,
 			"/usr/lib/libbiren-ml.so.1":                            defaultMountPathFunc,
@@ -175,7 +200,7 @@ func genSpec(resource string, mountHostPath bool) *cdi.Spec {
 	return spec
 }
 
-func generateConfigCdiFile(runtime ContainerRuntime) error {
+func generateConfigCdiFile(backend DeviceBackend, runtime ContainerRuntime, mountDriDevice bool, mountHostPath bool) (err error) {
 	if !CdiFeature {
 		log.Info("cdi feature isn't open")
 		return nil
@@ -190,8 +215,11 @@ func generateConfigCdiFile(runtime ContainerRuntime) error {
 		log.Infof("file already exists and no need to rewrite")
 		return nil
 	}
+	defer func() {
+		metrics.CDIGeneration(err)
+	}()
 
-	specs, err := cdiSPec(runtime)
+	specs, err := cdiSPec(backend, runtime, mountDriDevice, mountHostPath)
 	if err != nil {
 		return err
 	}
@@ -239,3 +267,12 @@ func PathExists(path string) (bool, error) {
 	}
 	return false, err
 }
+
+// removeCdiConfigFile removes the CDI spec written by generateConfigCdiFile.
+func removeCdiConfigFile() {
+	if err := os.Remove(cdiConfigPath); err != nil && !os.IsNotExist(err) {
+		log.Errorf("remove cdi config %s failed %v", cdiConfigPath, err)
+		return
+	}
+	log.Infof("Removed cdi config %s", cdiConfigPath)
+}
@@ -16,19 +16,36 @@ package brgpu
 import (
 	"testing"
 
-	"github.com/BirenTechnology/go-brml/brml"
-	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestGenerateFile(t *testing.T) {
-	err := brml.Init()
+	backend := NewBRMLBackend()
+	err := backend.Init()
 	if err != nil {
-		log.Error(err)
+		t.Skipf("brml is not available: %v", err)
 	}
-	defer brml.Shutdown()
+	defer backend.Shutdown()
 
-	err = generateConfigCdiFile(RuntimeRunc)
+	err = generateConfigCdiFile(backend, RuntimeRunc, false, false)
 	if err != nil {
 		t.Error(err)
 	}
 }
+
+func TestRuncCDI(t *testing.T) {
+	specs, err := runcCDI(newTestBackend(), nil, false)
+	assert.NoError(t, err)
+
+	devices := map[string][]string{}
+	for _, spec := range specs {
+		for _, d := range spec.Devices {
+			devices[spec.Kind] = append(devices[spec.Kind], d.Name)
+			assert.Equal(t, "/dev/biren/"+d.Name, d.ContainerEdits.DeviceNodes[0].Path)
+		}
+	}
+	assert.Equal(t, map[string][]string{
+		"birentech.com/gpu":     {"card_0", "card_1"},
+		"birentech.com/1-2-gpu": {"card_2", "card_3"},
+	}, devices)
+}
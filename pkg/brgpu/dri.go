@@ -0,0 +1,126 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	sysClassDrm = "/sys/class/drm"
+	driBasePath = "/dev/dri"
+	vgemDriver  = "vgem"
+)
+
+// renderNodes are the DRI render nodes cards are given. A card gets its own
+// render node when the Biren driver exposes one, and the one of vgem
+// otherwise.
+type renderNodes struct {
+	// cards maps the PCI bus ids of Biren cards to their render nodes.
+	cards map[string]string
+	vgem  string
+}
+
+// findRenderNodes looks up the render nodes below drmRoot. Render nodes of
+// other devices, like the onboard GPU of a BMC, are skipped.
+func findRenderNodes(drmRoot string) (renderNodes, error) {
+	paths, err := filepath.Glob(filepath.Join(drmRoot, "renderD*"))
+	if err != nil {
+		return renderNodes{}, err
+	}
+	res := renderNodes{cards: map[string]string{}}
+	for _, p := range paths {
+		node := filepath.Base(p)
+		driver, err := os.Readlink(filepath.Join(p, "device", "driver"))
+		if err != nil {
+			log.Debugf("read driver of render node %s err %v", node, err)
+			continue
+		}
+		if filepath.Base(driver) == vgemDriver {
+			if res.vgem == "" {
+				res.vgem = node
+			}
+			continue
+		}
+		vendor, err := os.ReadFile(filepath.Join(p, "device", "vendor"))
+		if err != nil || strings.TrimPrefix(strings.TrimSpace(string(vendor)), "0x") != BirenVendorID {
+			log.Debugf("skip render node %s of driver %s", node, filepath.Base(driver))
+			continue
+		}
+		dev, err := filepath.EvalSymlinks(filepath.Join(p, "device"))
+		if err != nil {
+			log.Debugf("read device of render node %s err %v", node, err)
+			continue
+		}
+		res.cards[filepath.Base(dev)] = node
+	}
+	return res, nil
+}
+
+// path returns the render node of the card or SVI instance with id.
+func (r renderNodes) path(backend DeviceBackend, id string) (string, error) {
+	index, err := cardID2Index(id)
+	if err != nil {
+		return "", err
+	}
+	dev, err := backend.HandleByNodeID(index)
+	if err != nil {
+		return "", err
+	}
+	pcie, err := backend.DevicePciInfo(dev)
+	if err != nil {
+		return "", err
+	}
+	busID := sysfsBusID(pcie)
+	if node, ok := r.cards[busID]; ok {
+		return filepath.Join(driBasePath, node), nil
+	}
+	if r.vgem != "" {
+		return filepath.Join(driBasePath, r.vgem), nil
+	}
+	return "", fmt.Errorf("no render node for %s at %s, the Biren driver has none for it and the vgem module is not loaded, load it with modprobe vgem on the host", id, busID)
+}
+
+// drmDevices returns the render nodes of the cards with the given ids, each
+// render node once.
+func drmDevices(backend DeviceBackend, drmRoot string, ids []string) ([]*pluginapi.DeviceSpec, error) {
+	nodes, err := findRenderNodes(drmRoot)
+	if err != nil {
+		return nil, err
+	}
+	res := []*pluginapi.DeviceSpec{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		path, err := nodes.path(backend, id)
+		if err != nil {
+			return nil, err
+		}
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		res = append(res, &pluginapi.DeviceSpec{
+			ContainerPath: path,
+			HostPath:      path,
+			Permissions:   "rw",
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type drmNode struct {
+	device string
+	vendor string
+	driver string
+}
+
+// fakeDrm builds a /sys/class/drm whose render nodes belong to the given
+// devices.
+func fakeDrm(t *testing.T, nodes map[string]drmNode) string {
+	root := t.TempDir()
+	for node, n := range nodes {
+		dev := filepath.Join(root, "devices", n.device)
+		driver := filepath.Join(root, "drivers", n.driver)
+		assert.NoError(t, os.MkdirAll(dev, 0755))
+		assert.NoError(t, os.MkdirAll(driver, 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dev, "vendor"), []byte(n.vendor+"\n"), 0644))
+		assert.NoError(t, os.Symlink(driver, filepath.Join(dev, "driver")))
+		assert.NoError(t, os.MkdirAll(filepath.Join(root, node), 0755))
+		assert.NoError(t, os.Symlink(dev, filepath.Join(root, node, "device")))
+	}
+	return root
+}
+
+var (
+	bmcNode  = drmNode{device: "0000:02:00.0", vendor: "0x1a03", driver: "ast"}
+	vgemNode = drmNode{device: "vgem", driver: "vgem"}
+)
+
+func TestDrmDevices(t *testing.T) {
+	backend := newTestBackend()
+
+	// a BMC holds renderD128, card 2 has a render node of its own and the
+	// other cards use vgem
+	root := fakeDrm(t, map[string]drmNode{
+		"renderD128": bmcNode,
+		"renderD129": vgemNode,
+		"renderD130": {device: "0000:3d:00.0", vendor: "0x1ee0", driver: "biren"},
+	})
+	devs, err := drmDevices(backend, root, []string{"card_0", "card_1", "card_2", "card_3"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/dev/dri/renderD129", "/dev/dri/renderD130"}, hostPaths(devs))
+
+	root = fakeDrm(t, map[string]drmNode{"renderD128": bmcNode})
+	_, err = drmDevices(backend, root, []string{"card_0"})
+	assert.EqualError(t, err, "no render node for card_0 at 0000:1a:00.0, the Biren driver has none for it and the vgem module is not loaded, load it with modprobe vgem on the host")
+
+	// vgem is not needed when every card has a render node
+	root = fakeDrm(t, map[string]drmNode{"renderD128": {device: "0000:1a:00.0", vendor: "0x1ee0", driver: "biren"}})
+	devs, err = drmDevices(backend, root, []string{"card_0"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/dev/dri/renderD128"}, hostPaths(devs))
+}
+
+func TestRuncCDIRenderNodes(t *testing.T) {
+	backend := newTestBackend()
+	dri, err := findRenderNodes(fakeDrm(t, map[string]drmNode{
+		"renderD128": bmcNode,
+		"renderD129": vgemNode,
+		"renderD130": {device: "0000:3d:00.0", vendor: "0x1ee0", driver: "biren"},
+	}))
+	assert.NoError(t, err)
+	specs, err := runcCDI(backend, &dri, false)
+	assert.NoError(t, err)
+
+	nodes := map[string][]string{}
+	for _, spec := range specs {
+		for _, d := range spec.Devices {
+			for _, n := range d.ContainerEdits.DeviceNodes {
+				nodes[d.Name] = append(nodes[d.Name], n.HostPath)
+			}
+		}
+	}
+	assert.Equal(t, map[string][]string{
+		"card_0": {"/dev/biren/card_0", "/dev/dri/renderD129"},
+		"card_1": {"/dev/biren/card_1", "/dev/dri/renderD129"},
+		"card_2": {"/dev/biren/card_2", "/dev/dri/renderD130"},
+		"card_3": {"/dev/biren/card_3", "/dev/dri/renderD130"},
+	}, nodes)
+
+	_, err = runcCDI(backend, &renderNodes{}, false)
+	assert.Error(t, err)
+}
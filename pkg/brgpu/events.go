@@ -0,0 +1,128 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/podresources"
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/utils"
+)
+
+const (
+	EventGPUUnhealthy       = "GPUUnhealthy"
+	EventGPURecovered       = "GPURecovered"
+	EventAllocationFailed   = "AllocationFailed"
+	EventCDISpecRegenerated = "CDISpecRegenerated"
+
+	eventComponent = "birentech-device-plugin"
+	// every object gets eventBurst events at once, then one per
+	// 1/eventQPS seconds, so a flapping card does not flood the API server.
+	eventBurst = 10
+	eventQPS   = 1.0 / 60
+)
+
+// Events records Kubernetes events against the node and, when they can be
+// identified, the pods involved. A nil Events records nothing.
+type Events struct {
+	// pods are the cached pods of node, nil when pods are not named.
+	pods        *utils.NodePods
+	node        string
+	recorder    record.EventRecorder
+	broadcaster record.EventBroadcaster
+}
+
+func NewEvents(client utils.Client, node string, pods *utils.NodePods) *Events {
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize: eventBurst,
+		QPS:       eventQPS,
+	})
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.K8s.CoreV1().Events("")})
+	return &Events{
+		pods:        pods,
+		node:        node,
+		broadcaster: broadcaster,
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent, Host: node}),
+	}
+}
+
+// Shutdown stops sending events.
+func (e *Events) Shutdown() {
+	if e == nil || e.broadcaster == nil {
+		return
+	}
+	e.broadcaster.Shutdown()
+}
+
+func (e *Events) nodeRef() *corev1.ObjectReference {
+	// kubelet uses the node name as UID too, so the events show up in
+	// kubectl describe node
+	return &corev1.ObjectReference{Kind: "Node", Name: e.node, UID: types.UID(e.node)}
+}
+
+func podRef(namespace, name string) *corev1.ObjectReference {
+	return &corev1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: namespace, Name: name}
+}
+
+// DeviceHealth records a device becoming healthy or unhealthy. holder is
+// the container using the device, its Pod is empty when the device is free.
+func (e *Events) DeviceHealth(dev pluginapi.Device, holder podresources.Allocation) {
+	if e == nil {
+		return
+	}
+	if dev.Health == pluginapi.Healthy {
+		e.recorder.Eventf(e.nodeRef(), corev1.EventTypeNormal, EventGPURecovered, "Device %s recovered", dev.ID)
+		return
+	}
+	e.recorder.Eventf(e.nodeRef(), corev1.EventTypeWarning, EventGPUUnhealthy, "Device %s became %s", dev.ID, dev.Health)
+	if holder.Pod != "" {
+		e.recorder.Eventf(podRef(holder.Namespace, holder.Pod), corev1.EventTypeWarning, EventGPUUnhealthy, "Device %s of container %s became %s", dev.ID, holder.Container, dev.Health)
+	}
+}
+
+// AllocationFailed records a failed Allocate call. The pod is only named
+// when a single cached pending pod asks for the same numbers of devices.
+func (e *Events) AllocationFailed(resource string, sizes []int, err error) {
+	if e == nil {
+		return
+	}
+	e.recorder.Eventf(e.nodeRef(), corev1.EventTypeWarning, EventAllocationFailed, "Allocating %s failed: %v", resource, err)
+	if e.pods == nil {
+		return
+	}
+	pods, lerr := e.pods.Pending()
+	if lerr != nil {
+		log.Errorf("list pending pods failed %v", lerr)
+		return
+	}
+	matched := matchingPods(pods, resource, sizes)
+	if len(matched) == 1 {
+		pod := matched[0]
+		e.recorder.Eventf(podRef(pod.Namespace, pod.Name), corev1.EventTypeWarning, EventAllocationFailed, "Allocating %s failed: %v", resource, err)
+	}
+}
+
+// CDISpecRegenerated records a CDI spec rewritten after the devices changed.
+func (e *Events) CDISpecRegenerated(runtime ContainerRuntime) {
+	if e == nil {
+		return
+	}
+	e.recorder.Eventf(e.nodeRef(), corev1.EventTypeNormal, EventCDISpecRegenerated, "CDI spec for %s regenerated after the devices changed", runtime)
+}
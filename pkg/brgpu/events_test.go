@@ -0,0 +1,108 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/podresources"
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/utils"
+)
+
+func recorded(r *record.FakeRecorder) []string {
+	res := []string{}
+	for {
+		select {
+		case e := <-r.Events:
+			res = append(res, e)
+		default:
+			return res
+		}
+	}
+}
+
+func TestEventsDeviceHealth(t *testing.T) {
+	r := record.NewFakeRecorder(10)
+	e := &Events{node: "node-1", recorder: r}
+	e.DeviceHealth(pluginapi.Device{ID: "card_1", Health: pluginapi.Unhealthy}, podresources.Allocation{})
+	e.DeviceHealth(pluginapi.Device{ID: "card_2", Health: pluginapi.Unhealthy}, podresources.Allocation{Namespace: "team-a", Pod: "train", Container: "main"})
+	e.DeviceHealth(pluginapi.Device{ID: "card_1", Health: pluginapi.Healthy}, podresources.Allocation{})
+	assert.Equal(t, []string{
+		"Warning GPUUnhealthy Device card_1 became Unhealthy",
+		"Warning GPUUnhealthy Device card_2 became Unhealthy",
+		"Warning GPUUnhealthy Device card_2 of container main became Unhealthy",
+		"Normal GPURecovered Device card_1 recovered",
+	}, recorded(r))
+
+	(*Events)(nil).DeviceHealth(pluginapi.Device{ID: "card_1"}, podresources.Allocation{})
+	(*Events)(nil).CDISpecRegenerated(RuntimeRunc)
+	(*Events)(nil).Shutdown()
+}
+
+func TestAllocateFailedEvent(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "train"},
+		Spec: corev1.PodSpec{NodeName: "node-1", Containers: []corev1.Container{{
+			Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{
+				"birentech.com/gpu": *resource.NewQuantity(1, resource.DecimalSI),
+			}},
+		}}},
+		Status: corev1.PodStatus{Phase: corev1.PodPending},
+	}
+	r := record.NewFakeRecorder(10)
+	stop := make(chan struct{})
+	defer close(stop)
+	pods := utils.Client{K8s: fake.NewSimpleClientset(pod)}.WatchNodePods(stop, "node-1")
+	assert.Eventually(t, pods.HasSynced, time.Second, 10*time.Millisecond)
+	info, err := DeviceDiscover(newTestBackend())
+	assert.NoError(t, err)
+	p := &Plugin{
+		Runtime:      string(RuntimeRunc),
+		BRGPUs:       info.FilterByName("gpu"),
+		resourceName: "gpu",
+		Events:       &Events{pods: pods, node: "node-1", recorder: r},
+	}
+
+	_, err = p.Allocate(context.Background(), &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"card_0"}},
+	}})
+	assert.NoError(t, err)
+	assert.Empty(t, recorded(r))
+
+	_, err = p.Allocate(context.Background(), &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"card_9"}},
+	}})
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		"Warning AllocationFailed Allocating gpu failed: invalid allocation request for gpu: unknown device card_9",
+		"Warning AllocationFailed Allocating gpu failed: invalid allocation request for gpu: unknown device card_9",
+	}, recorded(r))
+
+	// the pod is not named when it can not be told apart
+	_, err = p.Allocate(context.Background(), &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"card_0", "card_9"}},
+	}})
+	assert.Error(t, err)
+	assert.Len(t, recorded(r), 1)
+}
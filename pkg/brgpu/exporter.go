@@ -0,0 +1,137 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/metrics"
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/podresources"
+)
+
+const DefaultExporterInterval = 15 * time.Second
+
+// Exporter samples the telemetry of cards and SVI instances through the
+// backend and publishes it as metrics.
+type Exporter struct {
+	Backend  DeviceBackend
+	Interval time.Duration
+	// Pods labels devices with the containers holding them, it may be nil.
+	Pods *podresources.Tracker
+}
+
+// Run samples every Interval until stop is closed. The backend has to be
+// initialized.
+func (e *Exporter) Run(stop <-chan struct{}) {
+	interval := e.Interval
+	if interval <= 0 {
+		interval = DefaultExporterInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		e.Sample()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sample reads the telemetry of every device once.
+func (e *Exporter) Sample() {
+	info, err := DeviceDiscover(e.Backend)
+	if err != nil {
+		log.Errorf("exporter device discover failed %v", err)
+		return
+	}
+	devices := []metrics.DeviceSample{}
+	cards := []metrics.CardSample{}
+	for _, d := range info {
+		if len(d.Instances) == 0 {
+			continue
+		}
+		cards = append(cards, e.sampleCard(d))
+		for _, ins := range d.Instances {
+			devices = append(devices, e.sampleInstance(d.PhysicalNum, ins))
+		}
+	}
+	metrics.SetTelemetry(devices, cards)
+}
+
+func (e *Exporter) sampleCard(d DevicesInfo) metrics.CardSample {
+	sample := metrics.CardSample{PhysicalNum: d.PhysicalNum, Resource: d.Instances[0].ResourceName}
+	dev, err := e.Backend.HandleByIndex(d.PhysicalNum)
+	if err != nil {
+		log.Errorf("exporter get physical card %d failed %v", d.PhysicalNum, err)
+		return sample
+	}
+	if uuid, err := e.Backend.DeviceUUID(dev); err == nil {
+		sample.UUID = strings.TrimSpace(uuid)
+	}
+	if t, err := e.Backend.Temperature(dev); err == nil {
+		sample.TemperatureCelsius = float(float64(t))
+	} else {
+		log.Debugf("exporter temperature of physical card %d failed %v", d.PhysicalNum, err)
+	}
+	if p, err := e.Backend.PowerUsage(dev); err == nil {
+		sample.PowerWatts = float(float64(p) / 1000)
+	} else {
+		log.Debugf("exporter power usage of physical card %d failed %v", d.PhysicalNum, err)
+	}
+	return sample
+}
+
+func (e *Exporter) sampleInstance(physicalNum int, ins Instance) metrics.DeviceSample {
+	sample := metrics.DeviceSample{
+		CardID:      ins.CardID,
+		UUID:        ins.UUID,
+		PhysicalNum: physicalNum,
+		Resource:    ins.ResourceName,
+	}
+	if a, ok := e.Pods.Lookup(ins.deviceID()); ok {
+		sample.Namespace, sample.Pod, sample.Container = a.Namespace, a.Pod, a.Container
+	}
+	id, err := cardID2Index(ins.CardID)
+	if err != nil {
+		log.Errorf("exporter parse card id %s failed %v", ins.CardID, err)
+		return sample
+	}
+	dev, err := e.Backend.HandleByNodeID(id)
+	if err != nil {
+		log.Errorf("exporter get %s failed %v", ins.CardID, err)
+		return sample
+	}
+	if u, err := e.Backend.UtilizationRates(dev); err == nil {
+		sample.GPUUtilization = float(float64(u.Gpu))
+		sample.MemoryUtilization = float(float64(u.Memory))
+	} else {
+		log.Debugf("exporter utilization of %s failed %v", ins.CardID, err)
+	}
+	if m, err := e.Backend.MemoryInfo(dev); err == nil {
+		sample.MemoryUsedBytes = float(float64(m.Used))
+		sample.MemoryTotalBytes = float(float64(m.Total))
+	} else {
+		log.Debugf("exporter memory info of %s failed %v", ins.CardID, err)
+	}
+	return sample
+}
+
+func float(v float64) *float64 {
+	return &v
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/metrics"
+)
+
+func scrape(t *testing.T) string {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	assert.NoError(t, err)
+	return string(body)
+}
+
+func TestExporterSample(t *testing.T) {
+	fb := newTestBackend()
+	fb.Update(0, func(d *FakeDevice) {
+		d.Utilization = 40
+		d.MemoryUsed = 16 << 30
+		d.Temperature = 52
+		d.Power = 180500
+	})
+	fb.Update(2, func(d *FakeDevice) {
+		d.Instances[1].Utilization = 75
+		d.Instances[1].MemoryUsed = 8 << 30
+		d.Temperature = 47
+	})
+	e := &Exporter{Backend: fb}
+	e.Sample()
+
+	body := scrape(t)
+	for _, line := range []string{
+		`birentech_gpu_utilization_percent{card_id="card_0",container="",namespace="",physical_num="0",pod="",resource="gpu",uuid="GPU-0"} 40`,
+		`birentech_gpu_memory_utilization_percent{card_id="card_0",container="",namespace="",physical_num="0",pod="",resource="gpu",uuid="GPU-0"} 25`,
+		`birentech_gpu_memory_used_bytes{card_id="card_3",container="",namespace="",physical_num="2",pod="",resource="1-2-gpu",uuid="GPU-2-instance-1"} 8.589934592e+09`,
+		`birentech_gpu_utilization_percent{card_id="card_3",container="",namespace="",physical_num="2",pod="",resource="1-2-gpu",uuid="GPU-2-instance-1"} 75`,
+		`birentech_gpu_temperature_celsius{physical_num="0",resource="gpu",uuid="GPU-0"} 52`,
+		`birentech_gpu_power_usage_watts{physical_num="0",resource="gpu",uuid="GPU-0"} 180.5`,
+		`birentech_gpu_temperature_celsius{physical_num="2",resource="1-2-gpu",uuid="GPU-2"} 47`,
+	} {
+		assert.Contains(t, body, line)
+	}
+
+	// devices that went away stop being exported
+	fb.Update(1, func(d *FakeDevice) {
+		d.SviMode = 2
+		d.Instances = []FakeInstance{{NodeID: 1, Memory: 32 << 30}, {NodeID: 6, Memory: 32 << 30}}
+	})
+	e.Sample()
+	body = scrape(t)
+	assert.NotContains(t, body, `card_id="card_1",container="",namespace="",physical_num="1",pod="",resource="gpu"`)
+	assert.Contains(t, body, `birentech_gpu_memory_total_bytes{card_id="card_6",container="",namespace="",physical_num="1",pod="",resource="1-2-gpu",uuid="GPU-1-instance-1"}`)
+}
+
+type countingBackend struct {
+	*FakeBackend
+	inits     int
+	shutdowns int
+}
+
+func (c *countingBackend) Init() error {
+	c.inits++
+	return nil
+}
+
+func (c *countingBackend) Shutdown() error {
+	c.shutdowns++
+	return nil
+}
+
+func TestShareBackend(t *testing.T) {
+	c := &countingBackend{FakeBackend: newTestBackend()}
+	b := ShareBackend(c)
+	// the plugin and the exporter
+	assert.NoError(t, b.Init())
+	assert.NoError(t, b.Init())
+	assert.Equal(t, 1, c.inits)
+	assert.NoError(t, b.Shutdown())
+	assert.Equal(t, 0, c.shutdowns)
+	assert.NoError(t, b.Shutdown())
+	assert.Equal(t, 1, c.shutdowns)
+	assert.NoError(t, b.Shutdown())
+	assert.Equal(t, 1, c.shutdowns)
+}
@@ -0,0 +1,383 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/BirenTechnology/go-brml/brml"
+	"sigs.k8s.io/yaml"
+)
+
+// FakeInstance is an SVI instance of a FakeDevice.
+type FakeInstance struct {
+	NodeID      int    `json:"nodeID"`
+	Memory      uint64 `json:"memory"`
+	Processes   int    `json:"processes,omitempty"`
+	MemoryUsed  uint64 `json:"memoryUsed,omitempty"`
+	Utilization uint32 `json:"utilization,omitempty"`
+}
+
+// FakeDevice describes one physical card served by FakeBackend.
+type FakeDevice struct {
+	UUID    string `json:"uuid"`
+	Product string `json:"product,omitempty"`
+	// NodeID is the N of /dev/biren/card_N when the card is not split.
+	NodeID    int            `json:"nodeID"`
+	Memory    uint64         `json:"memory"`
+	BusID     string         `json:"busID"`
+	SviMode   int            `json:"sviMode"`
+	Instances []FakeInstance `json:"instances,omitempty"`
+	// Lost makes every lookup of the card fail, as if it fell off the bus.
+	Lost      bool                 `json:"lost,omitempty"`
+	Health    brml.GpuHealthStatus `json:"health,omitempty"`
+	EccErrors uint64               `json:"eccErrors,omitempty"`
+	AerErrors uint64               `json:"aerErrors,omitempty"`
+	Processes int                  `json:"processes,omitempty"`
+	// Telemetry reported for the whole card, power is in milliwatts.
+	MemoryUsed  uint64 `json:"memoryUsed,omitempty"`
+	Utilization uint32 `json:"utilization,omitempty"`
+	Temperature int    `json:"temperature,omitempty"`
+	Power       int    `json:"power,omitempty"`
+}
+
+// FakeBackend is an in-memory DeviceBackend driven by a fixture.
+type FakeBackend struct {
+	BRMLVersion string       `json:"version"`
+	Devices     []FakeDevice `json:"devices"`
+	// P2P holds the P2pLinkType between physical cards, indexed by their
+	// position in Devices. Missing entries mean no link between different
+	// cards and a direct link between instances of the same card.
+	P2P [][]uint32 `json:"p2p,omitempty"`
+
+	mu sync.Mutex
+}
+
+type fakeHandle struct {
+	card     int
+	instance int
+}
+
+// LoadFakeBackend reads a YAML or JSON fixture describing the fake cards.
+func LoadFakeBackend(path string) (*FakeBackend, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fb := &FakeBackend{}
+	if err := yaml.Unmarshal(data, fb); err != nil {
+		return nil, fmt.Errorf("parse fake backend fixture %s: %v", path, err)
+	}
+	return fb, nil
+}
+
+func (f *FakeBackend) Init() error {
+	return nil
+}
+
+func (f *FakeBackend) Shutdown() error {
+	return nil
+}
+
+func (f *FakeBackend) Version() (string, error) {
+	return f.BRMLVersion, nil
+}
+
+func (f *FakeBackend) DeviceCount() (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.Devices), nil
+}
+
+func (f *FakeBackend) HandleByIndex(index int) (DeviceHandle, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if index < 0 || index >= len(f.Devices) {
+		return nil, fmt.Errorf("fake device index %d out of range", index)
+	}
+	if f.Devices[index].Lost {
+		return nil, fmt.Errorf("fake device %s is lost", f.Devices[index].UUID)
+	}
+	return fakeHandle{card: index, instance: -1}, nil
+}
+
+func (f *FakeBackend) HandleByNodeID(id int) (DeviceHandle, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, d := range f.Devices {
+		if d.Lost {
+			continue
+		}
+		if d.SviMode <= 1 && d.NodeID == id {
+			return fakeHandle{card: i, instance: -1}, nil
+		}
+		if d.SviMode > 1 {
+			for j, ins := range d.Instances {
+				if ins.NodeID == id {
+					return fakeHandle{card: i, instance: j}, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("fake device node id %d not found", id)
+}
+
+func (f *FakeBackend) GetSviMode(device DeviceHandle) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, _, err := f.lookup(device)
+	if err != nil {
+		return 0, err
+	}
+	return d.SviMode, nil
+}
+
+func (f *FakeBackend) GetGPUInstanceByID(device DeviceHandle, id uint32) (DeviceHandle, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, h, err := f.lookup(device)
+	if err != nil {
+		return nil, err
+	}
+	if int(id) >= len(d.Instances) {
+		return nil, fmt.Errorf("fake device %s has no instance %d: %w", d.UUID, id, ErrInstanceNotFound)
+	}
+	return fakeHandle{card: h.card, instance: int(id)}, nil
+}
+
+func (f *FakeBackend) MemoryInfo(device DeviceHandle) (brml.Memory, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, h, err := f.lookup(device)
+	if err != nil {
+		return brml.Memory{}, err
+	}
+	if h.instance >= 0 {
+		ins := d.Instances[h.instance]
+		return brml.Memory{Total: ins.Memory, Used: ins.MemoryUsed, Freed: ins.Memory - ins.MemoryUsed}, nil
+	}
+	return brml.Memory{Total: d.Memory, Used: d.MemoryUsed, Freed: d.Memory - d.MemoryUsed}, nil
+}
+
+func (f *FakeBackend) DeviceUUID(device DeviceHandle) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, _, err := f.lookup(device)
+	if err != nil {
+		return "", err
+	}
+	return d.UUID, nil
+}
+
+func (f *FakeBackend) ProductName(device DeviceHandle) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, _, err := f.lookup(device)
+	if err != nil {
+		return "", err
+	}
+	return d.Product, nil
+}
+
+func (f *FakeBackend) DevicePciInfo(device DeviceHandle) (brml.PciInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, _, err := f.lookup(device)
+	if err != nil {
+		return brml.PciInfo{}, err
+	}
+	info := brml.PciInfo{}
+	for i := 0; i < len(d.BusID) && i < len(info.BusId)-1; i++ {
+		info.BusId[i] = int8(d.BusID[i])
+	}
+	return info, nil
+}
+
+func (f *FakeBackend) GetGPUNodeIds(device DeviceHandle) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, h, err := f.lookup(device)
+	if err != nil {
+		return 0, err
+	}
+	if h.instance >= 0 {
+		return d.Instances[h.instance].NodeID, nil
+	}
+	return d.NodeID, nil
+}
+
+func (f *FakeBackend) P2PStatusV2(device DeviceHandle, device2 DeviceHandle) (brml.P2pStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, h1, err := f.lookup(device)
+	if err != nil {
+		return brml.P2pStatus{}, err
+	}
+	_, h2, err := f.lookup(device2)
+	if err != nil {
+		return brml.P2pStatus{}, err
+	}
+	if h1.card < len(f.P2P) && h2.card < len(f.P2P[h1.card]) {
+		return brml.P2pStatus{Type: f.P2P[h1.card][h2.card]}, nil
+	}
+	if h1.card == h2.card {
+		return brml.P2pStatus{Type: uint32(brml.P2P_DIRECT_LINK)}, nil
+	}
+	return brml.P2pStatus{Type: uint32(brml.P2P_NO_LINK)}, nil
+}
+
+func (f *FakeBackend) HealthStatus(device DeviceHandle) (brml.GpuHealthStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, _, err := f.lookup(device)
+	if err != nil {
+		return 0, err
+	}
+	return d.Health, nil
+}
+
+func (f *FakeBackend) ErrorCounters(device DeviceHandle) (uint64, uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, _, err := f.lookup(device)
+	if err != nil {
+		return 0, 0, err
+	}
+	return d.EccErrors, d.AerErrors, nil
+}
+
+func (f *FakeBackend) RunningProcesses(device DeviceHandle) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, h, err := f.lookup(device)
+	if err != nil {
+		return 0, err
+	}
+	if h.instance >= 0 {
+		return d.Instances[h.instance].Processes, nil
+	}
+	return d.Processes, nil
+}
+
+func (f *FakeBackend) UtilizationRates(device DeviceHandle) (brml.Utilization, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, h, err := f.lookup(device)
+	if err != nil {
+		return brml.Utilization{}, err
+	}
+	total, used, util := d.Memory, d.MemoryUsed, d.Utilization
+	if h.instance >= 0 {
+		ins := d.Instances[h.instance]
+		total, used, util = ins.Memory, ins.MemoryUsed, ins.Utilization
+	}
+	res := brml.Utilization{Gpu: util}
+	if total > 0 {
+		res.Memory = uint32(used * 100 / total)
+	}
+	return res, nil
+}
+
+func (f *FakeBackend) Temperature(device DeviceHandle) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, _, err := f.lookup(device)
+	if err != nil {
+		return 0, err
+	}
+	return d.Temperature, nil
+}
+
+func (f *FakeBackend) PowerUsage(device DeviceHandle) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, _, err := f.lookup(device)
+	if err != nil {
+		return 0, err
+	}
+	return d.Power, nil
+}
+
+// SetSviMode splits the card into mode instances sharing its memory. The
+// first instance keeps the node id of the card, the others get node ids
+// above every node id in use, like the driver numbers new card_N nodes.
+func (f *FakeBackend) SetSviMode(device DeviceHandle, mode int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, h, err := f.lookup(device)
+	if err != nil {
+		return err
+	}
+	if h.instance >= 0 {
+		return fmt.Errorf("svi mode can only be set on a physical card")
+	}
+	if mode != 1 && mode != 2 && mode != 4 {
+		return fmt.Errorf("invalid svi mode %d", mode)
+	}
+	d := &f.Devices[h.card]
+	if d.SviMode > 1 && len(d.Instances) > 0 {
+		d.NodeID = d.Instances[0].NodeID
+	}
+	d.SviMode = mode
+	d.Instances = nil
+	if mode == 1 {
+		return nil
+	}
+	next := 0
+	for _, o := range f.Devices {
+		if o.NodeID >= next {
+			next = o.NodeID + 1
+		}
+		for _, ins := range o.Instances {
+			if ins.NodeID >= next {
+				next = ins.NodeID + 1
+			}
+		}
+	}
+	d.Instances = append(d.Instances, FakeInstance{NodeID: d.NodeID, Memory: d.Memory / uint64(mode)})
+	for i := 1; i < mode; i++ {
+		d.Instances = append(d.Instances, FakeInstance{NodeID: next, Memory: d.Memory / uint64(mode)})
+		next++
+	}
+	return nil
+}
+
+// Update lets tests and demos change a card while the plugin is running.
+func (f *FakeBackend) Update(index int, fn func(d *FakeDevice)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if index >= 0 && index < len(f.Devices) {
+		fn(&f.Devices[index])
+	}
+}
+
+func (f *FakeBackend) lookup(device DeviceHandle) (FakeDevice, fakeHandle, error) {
+	h, ok := device.(fakeHandle)
+	if !ok {
+		return FakeDevice{}, h, fmt.Errorf("handle %v is not a fake device", device)
+	}
+	if h.card < 0 || h.card >= len(f.Devices) {
+		return FakeDevice{}, h, fmt.Errorf("fake device index %d out of range", h.card)
+	}
+	d := f.Devices[h.card]
+	if d.Lost {
+		return FakeDevice{}, h, fmt.Errorf("fake device %s is lost", d.UUID)
+	}
+	if h.instance >= len(d.Instances) {
+		return FakeDevice{}, h, fmt.Errorf("fake device %s has no instance %d", d.UUID, h.instance)
+	}
+	return d, h, nil
+}
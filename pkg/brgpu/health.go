@@ -0,0 +1,148 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/BirenTechnology/go-brml/brml"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultHealthCheckInterval = 30 * time.Second
+	sysClassBiren              = "/sys/class/biren"
+	vfioBasePath               = "/dev/vfio"
+	// errorRecoveryPeriod is how long the error counters of an unhealthy card
+	// must stay unchanged before it is reported healthy again.
+	errorRecoveryPeriod = 5 * time.Minute
+)
+
+type errorCounters struct {
+	ecc uint64
+	aer uint64
+}
+
+// counterBaseline remembers the error counters a card is compared to, and
+// since when they last changed.
+type counterBaseline struct {
+	base  errorCounters
+	last  errorCounters
+	since time.Time
+}
+
+// healthChecker probes cards and SVI instances. Error counters are
+// cumulative, so a card is reported unhealthy once they grow past the values
+// seen on the first probe, and healthy again once they did not change for
+// errorRecoveryPeriod.
+type healthChecker struct {
+	backend  DeviceBackend
+	devRoot  string
+	sysRoot  string
+	pciRoot  string
+	vfioRoot string
+
+	now      func() time.Time
+	recovery time.Duration
+
+	mu        sync.Mutex
+	baselines map[int]*counterBaseline
+}
+
+func newHealthChecker(backend DeviceBackend) *healthChecker {
+	return &healthChecker{
+		backend:   backend,
+		devRoot:   deviceBasePath,
+		sysRoot:   sysClassBiren,
+		pciRoot:   basePath,
+		vfioRoot:  vfioBasePath,
+		now:       time.Now,
+		recovery:  errorRecoveryPeriod,
+		baselines: map[int]*counterBaseline{},
+	}
+}
+
+// checkInstance returns nil when the card or SVI instance is usable.
+func (h *healthChecker) checkInstance(physicalNum int, cardID string) error {
+	for _, p := range []string{filepath.Join(h.devRoot, cardID), filepath.Join(h.sysRoot, cardID)} {
+		if _, err := os.Stat(p); err != nil {
+			return fmt.Errorf("%s is missing: %v", p, err)
+		}
+	}
+
+	id, err := cardID2Index(cardID)
+	if err != nil {
+		return err
+	}
+	ins, err := h.backend.HandleByNodeID(id)
+	if err != nil {
+		return fmt.Errorf("lookup %s: %v", cardID, err)
+	}
+	if _, err := h.backend.MemoryInfo(ins); err != nil {
+		return fmt.Errorf("memory info of %s: %v", cardID, err)
+	}
+
+	dev, err := h.backend.HandleByIndex(physicalNum)
+	if err != nil {
+		return fmt.Errorf("lookup physical card %d: %v", physicalNum, err)
+	}
+	status, err := h.backend.HealthStatus(dev)
+	if err != nil {
+		log.Debugf("health status of physical card %d unavailable: %v", physicalNum, err)
+	} else if status == brml.HEALTH_STATUS_ERROR || status == brml.HEALTH_STATUS_CRITICAL_WARNING {
+		return fmt.Errorf("physical card %d reports health status %d", physicalNum, status)
+	}
+
+	ecc, aer, err := h.backend.ErrorCounters(dev)
+	if err != nil {
+		log.Debugf("error counters of physical card %d unavailable: %v", physicalNum, err)
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cur, now := errorCounters{ecc: ecc, aer: aer}, h.now()
+	b, ok := h.baselines[physicalNum]
+	if !ok {
+		h.baselines[physicalNum] = &counterBaseline{base: cur, last: cur, since: now}
+		return nil
+	}
+	if cur != b.last {
+		b.last = cur
+		b.since = now
+	}
+	if cur.ecc > b.base.ecc || cur.aer > b.base.aer {
+		if now.Sub(b.since) < h.recovery {
+			return fmt.Errorf("physical card %d error counters increased: ecc %d -> %d, aer %d -> %d",
+				physicalNum, b.base.ecc, ecc, b.base.aer, aer)
+		}
+		log.Infof("Error counters of physical card %d did not change for %s, taking them as the new baseline", physicalNum, h.recovery)
+	}
+	// counters reset by the driver lower the baseline as well
+	b.base = cur
+	return nil
+}
+
+// checkVF returns nil when the vfio group and PCI function of a VF exist.
+func (h *healthChecker) checkVF(vf VFDeviceInfo) error {
+	for _, p := range []string{filepath.Join(h.vfioRoot, vf.IOMMUGroup), filepath.Join(h.pciRoot, vf.Addr)} {
+		if _, err := os.Stat(p); err != nil {
+			return fmt.Errorf("%s is missing: %v", p, err)
+		}
+	}
+	return nil
+}
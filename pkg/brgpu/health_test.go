@@ -0,0 +1,155 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BirenTechnology/go-brml/brml"
+	"github.com/stretchr/testify/assert"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// newTestHealthPlugin returns a started runc plugin whose health checker
+// looks for device nodes below a temporary directory.
+func newTestHealthPlugin(t *testing.T, backend *FakeBackend) (*Plugin, string) {
+	root := t.TempDir()
+	info, err := DeviceDiscover(backend)
+	assert.NoError(t, err)
+	for _, id := range info.AllCardIDs() {
+		for _, dir := range []string{"dev", "sys"} {
+			assert.NoError(t, os.MkdirAll(filepath.Join(root, dir, id), 0755))
+		}
+	}
+
+	hc := newHealthChecker(backend)
+	hc.devRoot = filepath.Join(root, "dev")
+	hc.sysRoot = filepath.Join(root, "sys")
+	p := &Plugin{
+		Runtime: string(RuntimeRunc),
+		BRGPUs:  info,
+		Backend: backend,
+		health:  hc,
+	}
+	assert.NoError(t, p.Start())
+	t.Cleanup(func() { p.Stop() })
+	return p, root
+}
+
+func healthOf(devs []*pluginapi.Device) map[string]string {
+	res := map[string]string{}
+	for _, d := range devs {
+		res[d.ID] = d.Health
+	}
+	return res
+}
+
+func TestUpdateHealth(t *testing.T) {
+	backend := newTestBackend()
+	p, root := newTestHealthPlugin(t, backend)
+	devs := p.apiDevices()
+
+	assert.False(t, p.updateHealth(devs))
+
+	backend.Update(1, func(d *FakeDevice) { d.EccErrors++ })
+	assert.True(t, p.updateHealth(devs))
+	assert.Equal(t, pluginapi.Unhealthy, healthOf(devs)["card_1"])
+
+	backend.Update(2, func(d *FakeDevice) { d.Lost = true })
+	assert.True(t, p.updateHealth(devs))
+	assert.Equal(t, map[string]string{
+		"card_0": pluginapi.Healthy,
+		"card_1": pluginapi.Unhealthy,
+		"card_2": pluginapi.Unhealthy,
+		"card_3": pluginapi.Unhealthy,
+	}, healthOf(devs))
+
+	backend.Update(2, func(d *FakeDevice) { d.Lost = false })
+	assert.True(t, p.updateHealth(devs))
+	assert.Equal(t, pluginapi.Healthy, healthOf(devs)["card_2"])
+
+	backend.Update(0, func(d *FakeDevice) { d.Health = brml.HEALTH_STATUS_ERROR })
+	assert.NoError(t, os.RemoveAll(filepath.Join(root, "dev", "card_3")))
+	assert.True(t, p.updateHealth(devs))
+	assert.Equal(t, map[string]string{
+		"card_0": pluginapi.Unhealthy,
+		"card_1": pluginapi.Unhealthy,
+		"card_2": pluginapi.Healthy,
+		"card_3": pluginapi.Unhealthy,
+	}, healthOf(devs))
+}
+
+func TestUpdateHealthRecovers(t *testing.T) {
+	backend := newTestBackend()
+	p, _ := newTestHealthPlugin(t, backend)
+	now := time.Now()
+	p.health.now = func() time.Time { return now }
+	devs := p.apiDevices()
+
+	assert.False(t, p.updateHealth(devs))
+	backend.Update(1, func(d *FakeDevice) { d.AerErrors++ })
+	assert.True(t, p.updateHealth(devs))
+	assert.Equal(t, pluginapi.Unhealthy, healthOf(devs)["card_1"])
+
+	// still unhealthy while the counters keep growing
+	now = now.Add(errorRecoveryPeriod / 2)
+	backend.Update(1, func(d *FakeDevice) { d.AerErrors++ })
+	assert.False(t, p.updateHealth(devs))
+	now = now.Add(errorRecoveryPeriod / 2)
+	assert.False(t, p.updateHealth(devs))
+	assert.Equal(t, pluginapi.Unhealthy, healthOf(devs)["card_1"])
+
+	now = now.Add(errorRecoveryPeriod / 2)
+	assert.True(t, p.updateHealth(devs))
+	assert.Equal(t, pluginapi.Healthy, healthOf(devs)["card_1"])
+	assert.False(t, p.updateHealth(devs))
+}
+
+func TestUpdateHealthReportsTransitions(t *testing.T) {
+	backend := newTestBackend()
+	p, _ := newTestHealthPlugin(t, backend)
+	health := make(chan pluginapi.Device, 4)
+	p.Health = health
+	devs := p.apiDevices()
+
+	backend.Update(0, func(d *FakeDevice) { d.Lost = true })
+	p.updateHealth(devs)
+	assert.Equal(t, pluginapi.Device{ID: "card_0", Health: pluginapi.Unhealthy}, <-health)
+	assert.Len(t, health, 0)
+}
+
+func TestUpdateHealthKeepsStateAcrossRebuilds(t *testing.T) {
+	backend := newTestBackend()
+	p, _ := newTestHealthPlugin(t, backend)
+	health := make(chan pluginapi.Device, 4)
+	p.Health = health
+
+	backend.Update(0, func(d *FakeDevice) { d.Lost = true })
+	assert.True(t, p.updateHealth(p.apiDevices()))
+	assert.Equal(t, pluginapi.Device{ID: "card_0", Health: pluginapi.Unhealthy}, <-health)
+
+	// a rebuilt list starts healthy, still unhealthy devices are no transition
+	devs := p.apiDevices()
+	assert.True(t, p.updateHealth(devs))
+	assert.Equal(t, pluginapi.Unhealthy, healthOf(devs)["card_0"])
+	assert.Len(t, health, 0)
+
+	backend.Update(0, func(d *FakeDevice) { d.Lost = false })
+	devs = p.apiDevices()
+	assert.False(t, p.updateHealth(devs))
+	assert.Equal(t, pluginapi.Device{ID: "card_0", Health: pluginapi.Healthy}, <-health)
+}
@@ -14,10 +14,12 @@
 package brgpu
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -49,26 +51,39 @@ type PFDeviceInfo struct {
 
 type PFDeviceInfoList []PFDeviceInfo
 
+// ResourceNames returns the sorted resources of every VF, PFs without VFs
+// have none.
 func (p PFDeviceInfoList) ResourceNames() []string {
 	res := []string{}
-	names := map[string]int{}
+	names := map[string]bool{}
 	for _, v := range p {
-		names[v.VFs[0].ResourceName] += 1
-	}
-
-	for k, _ := range names {
-		res = append(res, k)
+		for _, vf := range v.VFs {
+			if !names[vf.ResourceName] {
+				names[vf.ResourceName] = true
+				res = append(res, vf.ResourceName)
+			}
+		}
 	}
+	sort.Strings(res)
 	return res
-
 }
 
+// FilterByName returns the PFs having VFs of resourceName, with only those
+// VFs.
 func (p PFDeviceInfoList) FilterByName(resourceName string) PFDeviceInfoList {
 	res := PFDeviceInfoList{}
 	for _, v := range p {
-		if v.VFs[0].ResourceName == resourceName {
-			res = append(res, v)
+		vfs := []VFDeviceInfo{}
+		for _, vf := range v.VFs {
+			if vf.ResourceName == resourceName {
+				vfs = append(vfs, vf)
+			}
 		}
+		if len(vfs) == 0 {
+			continue
+		}
+		v.VFs = vfs
+		res = append(res, v)
 	}
 	return res
 }
@@ -92,33 +107,62 @@ func (p PFDeviceInfoList) getResourceByCardId(cardId string) string {
 			}
 		}
 	}
-	return "gpu"
+	return GPUResourceName
 }
 
-func (bgm *brGPUManager) kataManager() {
+func (bgm *brGPUManager) kataManager(ctx context.Context) error {
 	info, err := vfDeviceDiscover()
 	if err != nil {
 		log.Errorf("kata device discover failed %v", err)
-		bgm.Stop <- true
+		return err
 	}
+	bgm.Labeler.Reconcile(KataNodeLabels(info))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	l := Lister{
-		ResUpdateChan:    make(chan dpm.PluginNameList),
-		Heartbeat:        make(chan bool),
-		PFDeviceInfoList: info,
-		Runtime:          string(RuntimeKata),
+		ResUpdateChan:  make(chan dpm.PluginNameList),
+		HealthInterval: bgm.HealthCheckInterval,
+		Health:         bgm.Health,
+		Runtime:        string(RuntimeKata),
+		Backend:        bgm.backend,
+		PodPolicy:      bgm.PodPolicy,
+		Events:         bgm.Events,
+		Done:           ctx.Done(),
+	}
+	regenerate := func() {
+		if err := bgm.writeCdiSpec(RuntimeKata, false); err != nil {
+			log.Errorf("kata regenerate cdi config failed %v", err)
+		} else if CdiFeature && OverwriteCdiConfig {
+			bgm.Events.CDISpecRegenerated(RuntimeKata)
+		}
+	}
+	bgm.setLister(&l, regenerate)
+	w := &deviceWatcher{
+		lister:   &l,
+		paths:    []string{vfioBasePath},
+		interval: bgm.RediscoverInterval,
+		discover: func() (DevicesInfoList, PFDeviceInfoList, error) {
+			info, err := vfDeviceDiscover()
+			return nil, info, err
+		},
+		onChange: regenerate,
+		onDiscover: func(_ DevicesInfoList, info PFDeviceInfoList) {
+			bgm.Labeler.Reconcile(KataNodeLabels(info))
+		},
 	}
-	manager := dpm.NewManager(&l)
 	go func() {
-		l.ResUpdateChan <- info.ResourceNames()
+		l.Update(nil, info)
+		w.run(ctx.Done())
 	}()
 
-	err = bgm.generateCdiConfigFile(RuntimeKata)
+	err = bgm.writeCdiSpec(RuntimeKata, false)
 	if err != nil {
 		log.Errorf("kata generate cdi config failed %v", err)
-		bgm.Stop <- true
+		return err
 	}
 
-	manager.Run()
+	return runPlugins(ctx, &l, nil)
 }
 
 func readIDFromFile(basePath string, deviceAddress string, property string) (string, error) {
@@ -201,15 +245,10 @@ func vfDeviceDiscover() (PFDeviceInfoList, error) {
 						}
 
 						vfs = append(vfs, VFDeviceInfo{
-							DeviceID:   deviceID,
-							IOMMUGroup: iommuGroup,
-							Addr:       vfAddr,
-							ResourceName: func() string {
-								if vfNum == 1 {
-									return "gpu"
-								}
-								return fmt.Sprintf("1-%d-gpu", vfNum)
-							}(),
+							DeviceID:     deviceID,
+							IOMMUGroup:   iommuGroup,
+							Addr:         vfAddr,
+							ResourceName: ResourceNaming.name("", vfNum),
 						})
 					}
 					pdl = append(pdl, PFDeviceInfo{
@@ -237,7 +276,7 @@ func vfDeviceDiscover() (PFDeviceInfoList, error) {
 								DeviceID:     deviceID,
 								IOMMUGroup:   iommuGroup,
 								Addr:         info.Name(),
-								ResourceName: "gpu",
+								ResourceName: ResourceNaming.name("", 1),
 							},
 						},
 					})
@@ -247,5 +286,8 @@ func vfDeviceDiscover() (PFDeviceInfoList, error) {
 
 		return nil
 	})
+	if err == nil && ResourceNaming.Aliases {
+		pdl = pdl.withAliases()
+	}
 	return pdl, err
 }
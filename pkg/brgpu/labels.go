@@ -0,0 +1,175 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BirenTechnology/go-brml/brml"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/utils"
+)
+
+// LabelPrefix starts the node labels published by the plugin, in the
+// resource namespace. Labels with it that are no longer wanted are removed.
+func LabelPrefix() string {
+	return ResourceNaming.Namespace + "/gpu."
+}
+
+// names of the node labels after LabelPrefix
+const (
+	LabelProduct       = "product"
+	LabelCount         = "count"
+	LabelMemory        = "memory"
+	LabelSviMode       = "svi-mode"
+	LabelDriverVersion = "driver-version"
+	LabelP2PCapable    = "p2p-capable"
+	LabelRuntime       = "runtime"
+)
+
+// NodeLabeler keeps the labels of Node in line with the discovered cards.
+type NodeLabeler struct {
+	Client utils.Client
+	Node   string
+}
+
+// Reconcile writes labels, named without LabelPrefix, to the node and drops
+// stale ones. It is safe to call on a nil NodeLabeler.
+func (n *NodeLabeler) Reconcile(labels map[string]string) {
+	if n == nil {
+		return
+	}
+	prefix := LabelPrefix()
+	prefixed := map[string]string{}
+	for k, v := range labels {
+		prefixed[prefix+k] = v
+	}
+	if err := n.Client.UpdateNodeLabels(n.Node, prefix, prefixed); err != nil {
+		log.Errorf("update labels of node %s failed %v", n.Node, err)
+	}
+}
+
+// NodeLabels describes the cards of a runc node. A node without cards gets
+// no labels.
+func NodeLabels(backend DeviceBackend, info DevicesInfoList) map[string]string {
+	labels := map[string]string{}
+	if len(info) == 0 {
+		return labels
+	}
+	labels[LabelCount] = strconv.Itoa(len(info))
+	labels[LabelRuntime] = string(RuntimeRunc)
+	labels[LabelSviMode] = sviModeLabel(info)
+
+	// the smallest card, so that pods selecting on it fit on every card
+	memory := 0
+	for _, d := range info {
+		total := 0
+		for _, ins := range d.Instances {
+			total += ins.Memory
+		}
+		if memory == 0 || total < memory {
+			memory = total
+		}
+	}
+	labels[LabelMemory] = strconv.Itoa(memory >> 20)
+
+	if version, err := backend.Version(); err != nil {
+		log.Errorf("get brml version failed %v", err)
+	} else if v := labelValue(version); v != "" {
+		labels[LabelDriverVersion] = v
+	}
+
+	handles := []DeviceHandle{}
+	for _, d := range info {
+		dev, err := backend.HandleByIndex(d.PhysicalNum)
+		if err != nil {
+			log.Errorf("get physical card %d failed %v", d.PhysicalNum, err)
+			continue
+		}
+		handles = append(handles, dev)
+	}
+	for _, dev := range handles {
+		product, err := backend.ProductName(dev)
+		if err != nil {
+			log.Errorf("get product name failed %v", err)
+			continue
+		}
+		if v := labelValue(product); v != "" {
+			labels[LabelProduct] = v
+			break
+		}
+	}
+	labels[LabelP2PCapable] = strconv.FormatBool(p2pCapable(backend, handles))
+	return labels
+}
+
+// KataNodeLabels describes the cards of a kata node, BRML is not used there.
+func KataNodeLabels(info PFDeviceInfoList) map[string]string {
+	labels := map[string]string{}
+	if len(info) == 0 {
+		return labels
+	}
+	labels[LabelCount] = strconv.Itoa(len(info))
+	labels[LabelRuntime] = string(RuntimeKata)
+	return labels
+}
+
+// sviModeLabel returns the partition size shared by all cards, or mixed.
+func sviModeLabel(info DevicesInfoList) string {
+	mode := 0
+	for _, d := range info {
+		if mode != 0 && d.SVICount != mode {
+			return "mixed"
+		}
+		mode = d.SVICount
+	}
+	for name, m := range partitionModes {
+		if m == mode {
+			return name
+		}
+	}
+	return strconv.Itoa(mode)
+}
+
+// p2pCapable reports whether any two physical cards are linked.
+func p2pCapable(backend DeviceBackend, handles []DeviceHandle) bool {
+	for i := range handles {
+		for j := i + 1; j < len(handles); j++ {
+			ps, err := backend.P2PStatusV2(handles[i], handles[j])
+			if err != nil {
+				log.Errorf("get p2p status failed %v", err)
+				continue
+			}
+			if ps.Type != uint32(brml.P2P_NO_LINK) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// labelValue turns s into a valid label value, which is at most 63
+// alphanumerics, '-', '_' or '.' starting and ending with an alphanumeric.
+func labelValue(s string) string {
+	v := invalidLabelChars.ReplaceAllString(strings.TrimSpace(s), "-")
+	if len(v) > 63 {
+		v = v[:63]
+	}
+	return strings.Trim(v, "-_.")
+}
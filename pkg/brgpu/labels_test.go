@@ -0,0 +1,90 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/utils"
+)
+
+func TestNodeLabels(t *testing.T) {
+	fb := newTestBackend()
+	fb.BRMLVersion = "2.3.0 (build 7)"
+	fb.Update(1, func(d *FakeDevice) { d.Product = "BR104P" })
+	info, err := DeviceDiscover(fb)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		LabelCount:         "3",
+		LabelRuntime:       "runc",
+		LabelSviMode:       "mixed",
+		LabelMemory:        "65536",
+		LabelDriverVersion: "2.3.0-build-7",
+		LabelProduct:       "BR104P",
+		LabelP2PCapable:    "true",
+	}, NodeLabels(fb, info))
+
+	fb.P2P = nil
+	info = info.FilterByName("1-2-gpu")
+	labels := NodeLabels(fb, info)
+	assert.Equal(t, "1-2", labels[LabelSviMode])
+	assert.Equal(t, "1", labels[LabelCount])
+	assert.Equal(t, "false", labels[LabelP2PCapable])
+	assert.NotContains(t, labels, LabelProduct)
+
+	assert.Empty(t, NodeLabels(fb, DevicesInfoList{}))
+	assert.Equal(t, map[string]string{LabelCount: "2", LabelRuntime: "kata"}, KataNodeLabels(PFDeviceInfoList{{}, {}}))
+}
+
+func TestNodeLabelerReconcile(t *testing.T) {
+	client := utils.Client{K8s: fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name: "node-1",
+		Labels: map[string]string{
+			"kubernetes.io/hostname":        "node-1",
+			"birentech.com/gpu.count":       "4",
+			"birentech.com/gpu.p2p-capable": "true",
+		},
+	}})}
+	l := &NodeLabeler{Client: client, Node: "node-1"}
+	l.Reconcile(map[string]string{LabelCount: "2", LabelRuntime: "runc"})
+
+	node, err := client.K8s.CoreV1().Nodes().Get(context.TODO(), "node-1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"kubernetes.io/hostname":    "node-1",
+		"birentech.com/gpu.count":   "2",
+		"birentech.com/gpu.runtime": "runc",
+	}, node.Labels)
+
+	// all cards gone
+	l.Reconcile(map[string]string{})
+	node, err = client.K8s.CoreV1().Nodes().Get(context.TODO(), "node-1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"kubernetes.io/hostname": "node-1"}, node.Labels)
+
+	(*NodeLabeler)(nil).Reconcile(map[string]string{LabelCount: "1"})
+}
+
+func TestLabelValue(t *testing.T) {
+	assert.Equal(t, "1.2.3", labelValue(" 1.2.3\n"))
+	assert.Equal(t, "BR104P-x", labelValue("BR104P (x)"))
+	assert.Equal(t, strings.Repeat("v", 63), labelValue(strings.Repeat("v", 70)))
+}
@@ -14,9 +14,15 @@
 package brgpu
 
 import (
-	"os"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/metrics"
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/podresources"
 	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
@@ -32,39 +38,222 @@ const (
 
 const (
 	vendor = "birentech.com"
+	// shutdownTimeout bounds the wait for the plugins to stop.
+	shutdownTimeout = 10 * time.Second
 )
 
 type Lister struct {
 	ResUpdateChan    chan dpm.PluginNameList
-	Heartbeat        chan bool
+	HealthInterval   time.Duration
+	Health           chan pluginapi.Device
 	MountAllDevice   bool
 	MountDriDevice   bool
 	DevicesInfoList  DevicesInfoList
 	PFDeviceInfoList PFDeviceInfoList
 	Runtime          string
 	MountHostPath    bool
+	Backend          DeviceBackend
+	SVIPolicy        SVIPolicy
+	Policy           Policy
+	PodPolicy        PodPolicyLookup
+	Events           *Events
+	// Sharing advertises the devices of some runc resources several times.
+	Sharing Sharing
+	// Done stops Update from waiting on dpm once closed.
+	Done <-chan struct{}
+
+	mu         sync.Mutex
+	plugins    map[string]*Plugin
+	advertised []string
+	served     map[string]servedResource
+}
+
+// servedResource is a resource as kubelet sees it.
+type servedResource struct {
+	// resource is the discovered resource whose devices it serves.
+	resource string
+	whole    bool
 }
 
 func (l *Lister) GetResourceNamespace() string {
-	return vendor
+	return ResourceNaming.Namespace
 }
 
 func (l *Lister) NewPlugin(resourceLastName string) dpm.PluginInterface {
-	return &Plugin{
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.served[resourceLastName]
+	if !ok {
+		s = servedResource{resource: resourceLastName}
+	}
+	pfDevices, brGPUs := l.devicesOf(s)
+	p := &Plugin{
 		Runtime:        l.Runtime,
-		PFDevices:      l.PFDeviceInfoList.FilterByName(resourceLastName),
-		BRGPUs:         l.DevicesInfoList.FilterByName(resourceLastName),
-		Heartbeat:      l.Heartbeat,
+		PFDevices:      pfDevices,
+		BRGPUs:         brGPUs,
+		NodeGPUs:       l.DevicesInfoList,
+		HealthInterval: l.HealthInterval,
+		Health:         l.Health,
 		MountAllDevice: l.MountAllDevice,
 		MountDriDevice: l.MountDriDevice,
 		MountHostPath:  l.MountHostPath,
+		Backend:        l.Backend,
+		SVIPolicy:      l.SVIPolicy,
+		Policy:         l.Policy,
+		PodPolicy:      l.PodPolicy,
+		Events:         l.Events,
+		Replicas:       l.Sharing.replicas(s.resource),
+		MemoryUnit:     l.Sharing.memoryUnit(s.whole),
+		resourceName:   resourceLastName,
+	}
+	if l.plugins == nil {
+		l.plugins = map[string]*Plugin{}
+	}
+	l.plugins[resourceLastName] = p
+	return p
+}
+
+// servedResources maps the advertised resources to the discovered ones,
+// sharing renames runc resources.
+func (l *Lister) servedResources() map[string]servedResource {
+	res := map[string]servedResource{}
+	add := func(resource string, parts int) {
+		whole := parts <= 1
+		name := resource
+		if l.Runtime == string(RuntimeRunc) {
+			name = l.Sharing.advertised(resource, whole)
+		}
+		if _, ok := res[name]; !ok {
+			res[name] = servedResource{resource: resource, whole: whole}
+		}
+	}
+	for _, d := range l.DevicesInfoList {
+		for _, ins := range d.Instances {
+			add(ins.ResourceName, d.SVICount)
+		}
+	}
+	for _, pf := range l.PFDeviceInfoList {
+		for _, vf := range pf.VFs {
+			add(vf.ResourceName, pf.VFCount)
+		}
 	}
+	return res
+}
+
+// devicesOf returns the devices of the resource s serves.
+func (l *Lister) devicesOf(s servedResource) (PFDeviceInfoList, DevicesInfoList) {
+	return l.PFDeviceInfoList.FilterByName(s.resource), l.DevicesInfoList.FilterByName(s.resource)
+}
+
+// Update replaces the discovered devices, hands the new device lists to the
+// running plugins and tells dpm about added or removed resources. It reports
+// whether anything changed.
+func (l *Lister) Update(info DevicesInfoList, pfInfo PFDeviceInfoList) bool {
+	l.mu.Lock()
+	changed := l.advertised == nil ||
+		!reflect.DeepEqual(l.DevicesInfoList, info) ||
+		!reflect.DeepEqual(l.PFDeviceInfoList, pfInfo)
+	l.DevicesInfoList = info
+	l.PFDeviceInfoList = pfInfo
+	l.served = l.servedResources()
+	names := []string{}
+	for name := range l.served {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for name, p := range l.plugins {
+		s, ok := l.served[name]
+		if !ok {
+			delete(l.plugins, name)
+			metrics.DeleteResource(name)
+			continue
+		}
+		pfDevices, brGPUs := l.devicesOf(s)
+		p.setDevices(pfDevices, brGPUs, l.DevicesInfoList)
+	}
+	namesChanged := l.advertised == nil || !reflect.DeepEqual(l.advertised, names)
+	l.advertised = names
+	l.mu.Unlock()
+
+	if namesChanged {
+		log.Infof("Advertising resources %v", names)
+		select {
+		case l.ResUpdateChan <- names:
+		case <-l.Done:
+		}
+	}
+	return changed
+}
+
+// Settings are the plugin settings that can change while serving.
+type Settings struct {
+	Policy         Policy
+	SVIPolicy      SVIPolicy
+	MountHostPath  bool
+	MountDriDevice bool
+	MountAllDevice bool
+}
+
+// Reload hands settings to the running plugins and the ones created later.
+func (l *Lister) Reload(s Settings) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Policy = s.Policy
+	l.SVIPolicy = s.SVIPolicy
+	l.MountHostPath = s.MountHostPath
+	l.MountDriDevice = s.MountDriDevice
+	l.MountAllDevice = s.MountAllDevice
+	for _, p := range l.plugins {
+		p.setSettings(s)
+	}
+}
+
+// stopPlugins makes dpm stop every plugin, which removes their sockets, and
+// waits for them. dpm may handle a signal meanwhile, it then stops the
+// plugins itself.
+func (l *Lister) stopPlugins(dpmDone <-chan struct{}) {
+	timeout := time.NewTimer(shutdownTimeout)
+	defer timeout.Stop()
+	select {
+	case l.ResUpdateChan <- dpm.PluginNameList{}:
+	case <-dpmDone:
+		return
+	case <-timeout.C:
+		log.Warn("Timed out stopping the device plugins")
+		return
+	}
+
+	l.mu.Lock()
+	plugins := []*Plugin{}
+	for _, p := range l.plugins {
+		plugins = append(plugins, p)
+	}
+	l.mu.Unlock()
+	for _, p := range plugins {
+		select {
+		case <-p.stopped():
+		case <-dpmDone:
+			return
+		case <-timeout.C:
+			log.Warn("Timed out stopping the device plugins")
+			return
+		}
+	}
+	log.Info("Device plugins stopped")
 }
 func (l *Lister) Discover(pluginListCh chan dpm.PluginNameList) {
 	for {
 		select {
 		case newResourcesList := <-l.ResUpdateChan: // New resources found
-			pluginListCh <- newResourcesList
+			// both cases are ready once dpm closed the channel
+			select {
+			case <-pluginListCh:
+				return
+			default:
+			}
+			if !forwardResources(pluginListCh, newResourcesList) {
+				return
+			}
 		case <-pluginListCh: // Stop message received
 			// Stop resourceUpdateCh
 			return
@@ -72,6 +261,30 @@ func (l *Lister) Discover(pluginListCh chan dpm.PluginNameList) {
 	}
 }
 
+// forwardResources hands names to dpm and reports whether dpm took them.
+// dpm closes pluginListCh when it stops on a signal, which may still happen
+// while names are forwarded, so the send on the closed channel is
+// recovered.
+func forwardResources(pluginListCh chan<- dpm.PluginNameList, names dpm.PluginNameList) (sent bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Debugf("device plugin manager stopped before taking resources %v", names)
+			sent = false
+		}
+	}()
+	pluginListCh <- names
+	return true
+}
+
+func containString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 type MountPath struct {
 	HostPath      string
 	ContainerPath string
@@ -88,46 +301,203 @@ type brGPUManager struct {
 	devices        map[string]pluginapi.Device
 	grpcServer     *grpc.Server
 	socket         string
-	Stop           chan bool
 	devicesMutex   sync.Mutex
 	gpuConfig      GPUConfig
 	Health         chan pluginapi.Device
+	backend        DeviceBackend
+
+	// HealthCheckInterval is how often plugins probe their devices, zero
+	// disables probing after the initial check.
+	HealthCheckInterval time.Duration
+	// RediscoverInterval is how often devices are rediscovered in addition
+	// to the rediscovery triggered by device node changes.
+	RediscoverInterval time.Duration
+	// SVIPolicy picks SVI instances for preferred allocations.
+	SVIPolicy SVIPolicy
+	// Policy picks devices for preferred allocations, PodPolicy looks up
+	// the policy a pod overrides it with.
+	Policy    Policy
+	PodPolicy PodPolicyLookup
+	// Pods tells which container holds a device, it may be nil.
+	Pods *podresources.Tracker
+	// Labeler publishes node labels describing the cards, it may be nil.
+	Labeler *NodeLabeler
+	// Events records Kubernetes events, it may be nil.
+	Events *Events
+	// InitTolerateLevel decides which failures of bringing up brml and the
+	// cards are retried instead of stopping the plugin.
+	InitTolerateLevel int
+	// Sharing advertises the devices of some resources several times in
+	// runc mode.
+	Sharing Sharing
+	// MountHostPath mounts the /usr of the host in containers until settings
+	// are reloaded.
+	MountHostPath bool
+
+	listerMu sync.Mutex
+	lister   *Lister
+	reloaded *Settings
+	// regenerateCdi writes the CDI spec of the devices being served again.
+	regenerateCdi func()
 
 	// 生成 cdi config
-	generateCdiConfigFile func(runtime ContainerRuntime) error
+	cdiMu                 sync.Mutex
+	generateCdiConfigFile func(backend DeviceBackend, runtime ContainerRuntime, mountDriDevice bool, mountHostPath bool) error
 }
 
-func NewBrGPUManager(devDirectory string, gpuConfig GPUConfig) *brGPUManager {
+func NewBrGPUManager(devDirectory string, gpuConfig GPUConfig, backend DeviceBackend) *brGPUManager {
 	return &brGPUManager{
 		devDirectory:          devDirectory,
+		backend:               backend,
 		devices:               make(map[string]pluginapi.Device),
-		Stop:                  make(chan bool),
 		gpuConfig:             gpuConfig,
 		Health:                make(chan pluginapi.Device),
+		HealthCheckInterval:   DefaultHealthCheckInterval,
+		RediscoverInterval:    DefaultRediscoverInterval,
+		SVIPolicy:             SVIPolicyPack,
 		generateCdiConfigFile: generateConfigCdiFile,
 	}
 }
 
+// watchHealth consumes the health transitions reported by the plugins.
+func (bgm *brGPUManager) watchHealth() {
+	for dev := range bgm.Health {
+		holder, used := bgm.Pods.Lookup(dev.ID)
+		bgm.Events.DeviceHealth(dev, holder)
+		if dev.Health == pluginapi.Healthy {
+			log.Infof("Device %s recovered", dev.ID)
+			continue
+		}
+		if used {
+			log.Warnf("Device %s used by %s/%s container %s became %s", dev.ID, holder.Namespace, holder.Pod, holder.Container, dev.Health)
+			continue
+		}
+		log.Warnf("Device %s became %s", dev.ID, dev.Health)
+	}
+}
+
 func (bgm *brGPUManager) ListDevices() map[string]pluginapi.Device {
+	return bgm.devices
+}
+
+// applyPartition puts the cards into the SVI modes of GPUPartitionSize, the
+// plugin does not start with cards it could not partition.
+func (bgm *brGPUManager) applyPartition() error {
 	if bgm.gpuConfig.GPUPartitionSize == "" {
-		return bgm.devices
+		return nil
+	}
+	layout, err := ParsePartitionSize(bgm.gpuConfig.GPUPartitionSize)
+	if err != nil {
+		return err
+	}
+	if err := ApplyPartition(bgm.backend, layout); err != nil {
+		return fmt.Errorf("apply gpu partition size %s: %v", bgm.gpuConfig.GPUPartitionSize, err)
+	}
+	return nil
+}
+
+// Reload applies settings to the plugins being served, and writes the CDI
+// spec again when the host path mount changed.
+func (bgm *brGPUManager) Reload(s Settings) {
+	bgm.listerMu.Lock()
+	changed := s.MountHostPath != bgm.mountHostPathLocked()
+	bgm.reloaded = &s
+	if bgm.lister != nil {
+		bgm.lister.Reload(s)
+	}
+	regenerate := bgm.regenerateCdi
+	bgm.listerMu.Unlock()
+	if changed && regenerate != nil {
+		regenerate()
+	}
+}
+
+// setLister records the lister of the plugins being served and hands it the
+// settings reloaded before, regenerate writes the CDI spec of its devices.
+func (bgm *brGPUManager) setLister(l *Lister, regenerate func()) {
+	bgm.listerMu.Lock()
+	defer bgm.listerMu.Unlock()
+	bgm.lister = l
+	bgm.regenerateCdi = regenerate
+	if bgm.reloaded != nil {
+		l.Reload(*bgm.reloaded)
 	}
-	return map[string]pluginapi.Device{}
 }
 
-func (bgm *brGPUManager) Serve(pulse int, mountAllDev bool, mountDriDevice bool, runtime string) {
+// mountHostPath tells whether containers get the /usr of the host with the
+// current settings.
+func (bgm *brGPUManager) mountHostPath() bool {
+	bgm.listerMu.Lock()
+	defer bgm.listerMu.Unlock()
+	return bgm.mountHostPathLocked()
+}
+
+func (bgm *brGPUManager) mountHostPathLocked() bool {
+	if bgm.reloaded != nil {
+		return bgm.reloaded.MountHostPath
+	}
+	return bgm.MountHostPath
+}
+
+// writeCdiSpec generates the CDI spec of runtime with the mounts of the
+// current settings.
+func (bgm *brGPUManager) writeCdiSpec(runtime ContainerRuntime, mountDriDevice bool) error {
+	bgm.cdiMu.Lock()
+	defer bgm.cdiMu.Unlock()
+	return bgm.generateCdiConfigFile(bgm.backend, runtime, mountDriDevice, bgm.mountHostPath())
+}
+
+// Serve serves the devices to kubelet until ctx is done or serving fails.
+// The plugins are stopped and their sockets removed before it returns.
+func (bgm *brGPUManager) Serve(ctx context.Context, pulse int, mountAllDev bool, mountDriDevice bool, runtime string) error {
 	log.Info("Container runtime: ", runtime)
-	go func() {
-		<-bgm.Stop
-		close(bgm.Stop)
-		os.Exit(1)
-	}()
+	go bgm.watchHealth()
 
+	var err error
 	switch runtime {
 	case string(RuntimeKata):
-		bgm.kataManager()
+		if bgm.gpuConfig.GPUPartitionSize != "" {
+			log.Warnf("GPU partition size %s is ignored with the kata runtime", bgm.gpuConfig.GPUPartitionSize)
+		}
+		if len(bgm.Sharing.Replicas) > 0 || bgm.Sharing.MemoryUnit > 0 {
+			log.Warnf("Sharing %+v is ignored with the kata runtime", bgm.Sharing)
+		}
+		if IDStrategy != DeviceIDIndex {
+			log.Warnf("Device id strategy %s is ignored with the kata runtime, VFs are named by their vfio path", IDStrategy)
+		}
+		err = bgm.kataManager(ctx)
 	case string(RuntimeRunc):
-		bgm.runcManager(pulse, mountAllDev, mountDriDevice)
+		err = bgm.runcManager(ctx, pulse, mountAllDev, mountDriDevice)
+	default:
+		return fmt.Errorf("can't find any manager for runtime %s", runtime)
+	}
+	if CdiFeature && RemoveCdiConfig {
+		removeCdiConfigFile()
+	}
+	return err
+}
+
+// runPlugins runs dpm with l until ctx is done, dpm stops on a signal or
+// failed reports an error. The plugins are stopped before it returns.
+func runPlugins(ctx context.Context, l *Lister, failed <-chan error) error {
+	manager := dpm.NewManager(l)
+	dpmDone := make(chan struct{})
+	go func() {
+		manager.Run()
+		close(dpmDone)
+	}()
+
+	select {
+	case <-dpmDone:
+		log.Info("Device plugins stopped")
+		return nil
+	case err := <-failed:
+		l.stopPlugins(dpmDone)
+		return err
+	case <-ctx.Done():
+		// dpm only stops by itself on a signal, ctx also ends to restart
+		// with a new config profile
+		l.stopPlugins(dpmDone)
+		return nil
 	}
-	log.Error("Can't find any manager for runtime ", runtime)
 }
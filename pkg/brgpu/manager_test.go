@@ -0,0 +1,259 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListerUpdate(t *testing.T) {
+	backend := newTestBackend()
+	l := &Lister{
+		ResUpdateChan: make(chan dpm.PluginNameList, 4),
+		Runtime:       string(RuntimeRunc),
+		Backend:       backend,
+	}
+	discover := func() DevicesInfoList {
+		info, err := DeviceDiscover(backend)
+		assert.NoError(t, err)
+		return info
+	}
+
+	assert.True(t, l.Update(discover(), nil))
+	assert.Equal(t, dpm.PluginNameList{"1-2-gpu", "gpu"}, <-l.ResUpdateChan)
+	p := l.NewPlugin("gpu").(*Plugin)
+	assert.NoError(t, p.Start())
+	defer p.Stop()
+
+	assert.False(t, l.Update(discover(), nil))
+	assert.Len(t, l.ResUpdateChan, 0)
+
+	// Splitting card 1 keeps the resource names but shrinks the gpu plugin.
+	backend.Update(1, func(d *FakeDevice) {
+		d.SviMode = 2
+		d.Instances = []FakeInstance{{NodeID: 4}, {NodeID: 5}}
+	})
+	assert.True(t, l.Update(discover(), nil))
+	assert.Len(t, l.ResUpdateChan, 0)
+	_, gpus := p.devices()
+	assert.Equal(t, []string{"card_0"}, gpus.AllCardIDs())
+	assert.Len(t, p.changed, 1)
+
+	// Splitting card 0 into four removes the gpu resource.
+	backend.Update(0, func(d *FakeDevice) {
+		d.SviMode = 4
+		d.Instances = []FakeInstance{{NodeID: 6}, {NodeID: 7}, {NodeID: 8}, {NodeID: 9}}
+	})
+	assert.True(t, l.Update(discover(), nil))
+	assert.Equal(t, dpm.PluginNameList{"1-2-gpu", "1-4-gpu"}, <-l.ResUpdateChan)
+	assert.NotContains(t, l.plugins, "gpu")
+}
+
+func TestListerShutdown(t *testing.T) {
+	backend := newTestBackend()
+	info, err := DeviceDiscover(backend)
+	assert.NoError(t, err)
+	done := make(chan struct{})
+	l := &Lister{
+		ResUpdateChan: make(chan dpm.PluginNameList),
+		Runtime:       string(RuntimeRunc),
+		Backend:       backend,
+		Done:          done,
+	}
+
+	// nobody reads the updates once dpm stopped
+	close(done)
+	assert.True(t, l.Update(info, nil))
+
+	p := l.NewPlugin("gpu").(*Plugin)
+	assert.NoError(t, p.Start())
+	dpmDone := make(chan struct{})
+	go func() {
+		// what dpm does with an empty plugin list
+		assert.Equal(t, dpm.PluginNameList{}, <-l.ResUpdateChan)
+		assert.NoError(t, p.Stop())
+	}()
+	stopped := make(chan struct{})
+	go func() {
+		l.stopPlugins(dpmDone)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		t.Fatal("plugins not stopped")
+	}
+}
+
+func TestDiscoverClosedChannel(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		l := &Lister{ResUpdateChan: make(chan dpm.PluginNameList, 1)}
+		// dpm stopped while an update was on its way
+		l.ResUpdateChan <- dpm.PluginNameList{"gpu"}
+		pluginsCh := closedPluginsCh()
+		returned := make(chan struct{})
+		go func() {
+			l.Discover(pluginsCh)
+			close(returned)
+		}()
+		select {
+		case <-returned:
+		case <-time.After(time.Second):
+			t.Fatal("discover did not return")
+		}
+	}
+	assert.False(t, forwardResources(closedPluginsCh(), dpm.PluginNameList{"gpu"}))
+}
+
+func closedPluginsCh() chan dpm.PluginNameList {
+	ch := make(chan dpm.PluginNameList)
+	close(ch)
+	return ch
+}
+
+func TestListerReload(t *testing.T) {
+	backend := newTestBackend()
+	info, err := DeviceDiscover(backend)
+	assert.NoError(t, err)
+	l := &Lister{
+		ResUpdateChan: make(chan dpm.PluginNameList, 1),
+		Runtime:       string(RuntimeRunc),
+		Backend:       backend,
+		Policy:        topologyBest{svi: SVIPolicyPack},
+	}
+	l.Update(info, nil)
+	p := l.NewPlugin("gpu").(*Plugin)
+
+	l.Reload(Settings{Policy: spread{}, SVIPolicy: SVIPolicySpread, MountDriDevice: true})
+	assert.Equal(t, PolicySpread, p.allocationPolicy(nil).Name())
+	assert.Equal(t, SVIPolicySpread, p.SVIPolicy)
+	assert.True(t, p.MountDriDevice)
+	assert.Equal(t, PolicySpread, l.NewPlugin("1-2-gpu").(*Plugin).allocationPolicy(nil).Name())
+}
+
+func TestManagerReloadHostPath(t *testing.T) {
+	bgm := NewBrGPUManager("", GPUConfig{}, newTestBackend())
+	written := []bool{}
+	bgm.generateCdiConfigFile = func(_ DeviceBackend, _ ContainerRuntime, _ bool, mountHostPath bool) error {
+		written = append(written, mountHostPath)
+		return nil
+	}
+	l := &Lister{ResUpdateChan: make(chan dpm.PluginNameList, 1), Runtime: string(RuntimeRunc)}
+	bgm.setLister(l, func() { assert.NoError(t, bgm.writeCdiSpec(RuntimeRunc, false)) })
+	assert.NoError(t, bgm.writeCdiSpec(RuntimeRunc, false))
+
+	// only a change of the host path mount writes the spec again
+	bgm.Reload(Settings{Policy: spread{}, MountDriDevice: true})
+	bgm.Reload(Settings{Policy: spread{}, MountHostPath: true})
+	bgm.Reload(Settings{Policy: spread{}, MountHostPath: true, MountAllDevice: true})
+	assert.Equal(t, []bool{false, true}, written)
+	assert.True(t, l.MountHostPath)
+}
+
+func TestListerMixedNode(t *testing.T) {
+	backend := &FakeBackend{
+		BRMLVersion: "1.0.0",
+		Devices: []FakeDevice{
+			{UUID: "GPU-0", NodeID: 0, Memory: 64 << 30, BusID: "0000:1a:00.0", SviMode: 1},
+			{UUID: "GPU-1", Memory: 64 << 30, BusID: "0000:1b:00.0", SviMode: 2, Instances: []FakeInstance{
+				{NodeID: 1, Memory: 32 << 30},
+				{NodeID: 2, Memory: 32 << 30},
+			}},
+			{UUID: "GPU-2", Memory: 64 << 30, BusID: "0000:3d:00.0", SviMode: 4, Instances: []FakeInstance{
+				{NodeID: 3, Memory: 16 << 30},
+				{NodeID: 4, Memory: 16 << 30},
+				{NodeID: 5, Memory: 16 << 30},
+				{NodeID: 6, Memory: 16 << 30},
+			}},
+			// being split, its instances are not there yet
+			{UUID: "GPU-3", NodeID: 7, Memory: 64 << 30, BusID: "0000:3e:00.0", SviMode: 2},
+		},
+	}
+	info, err := DeviceDiscover(backend)
+	assert.NoError(t, err)
+	assert.Len(t, info, 4)
+	assert.Empty(t, info[3].Instances)
+
+	l := &Lister{
+		ResUpdateChan: make(chan dpm.PluginNameList, 1),
+		Runtime:       string(RuntimeRunc),
+		Backend:       backend,
+	}
+	assert.True(t, l.Update(info, nil))
+	assert.Equal(t, dpm.PluginNameList{"1-2-gpu", "1-4-gpu", "gpu"}, <-l.ResUpdateChan)
+	for name, ids := range map[string][]string{
+		"gpu":     {"card_0"},
+		"1-2-gpu": {"card_1", "card_2"},
+		"1-4-gpu": {"card_3", "card_4", "card_5", "card_6"},
+	} {
+		p := l.NewPlugin(name).(*Plugin)
+		_, gpus := p.devices()
+		assert.Equal(t, ids, gpus.AllCardIDs(), name)
+		assert.Len(t, p.apiDevices(), len(ids), name)
+	}
+
+	// the instances show up once the card is split
+	backend.Update(3, func(d *FakeDevice) {
+		d.Instances = []FakeInstance{{NodeID: 7, Memory: 32 << 30}, {NodeID: 8, Memory: 32 << 30}}
+	})
+	info, err = DeviceDiscover(backend)
+	assert.NoError(t, err)
+	assert.True(t, l.Update(info, nil))
+	assert.Len(t, l.ResUpdateChan, 0)
+	_, gpus := l.plugins["1-2-gpu"].devices()
+	assert.Equal(t, []string{"card_1", "card_2", "card_7", "card_8"}, gpus.AllCardIDs())
+}
+
+func TestFilterByName(t *testing.T) {
+	// instances of one card with different resources go to their own plugins
+	info := DevicesInfoList{
+		{PhysicalNum: 0, SVICount: 2, Instances: []Instance{
+			{CardID: "card_0", ResourceName: "1-2-gpu"},
+			{CardID: "card_1", ResourceName: "1-2-gpu-b"},
+		}},
+		{PhysicalNum: 1, SVICount: 2},
+	}
+	assert.Equal(t, []string{"1-2-gpu", "1-2-gpu-b"}, info.ResourceNames())
+	assert.Equal(t, []string{"card_1"}, info.FilterByName("1-2-gpu-b").AllCardIDs())
+	assert.Len(t, info.FilterByName("1-2-gpu")[0].Instances, 1)
+	assert.Len(t, info[0].Instances, 2)
+	assert.Empty(t, info.FilterByName("gpu"))
+
+	pfs := PFDeviceInfoList{
+		{Addr: "0000:1a:00.0", VFCount: 1, VFs: []VFDeviceInfo{{IOMMUGroup: "1", ResourceName: "gpu"}}},
+		{Addr: "0000:1b:00.0", VFCount: 2, VFs: []VFDeviceInfo{
+			{IOMMUGroup: "2", ResourceName: "1-2-gpu"},
+			{IOMMUGroup: "3", ResourceName: "1-2-gpu"},
+		}},
+		// SR-IOV enabled without VFs
+		{Addr: "0000:3d:00.0"},
+	}
+	assert.Equal(t, []string{"1-2-gpu", "gpu"}, pfs.ResourceNames())
+	assert.Len(t, pfs.FilterByName("1-2-gpu"), 1)
+	assert.Len(t, pfs.FilterByName("1-2-gpu")[0].VFs, 2)
+
+	l := &Lister{
+		ResUpdateChan: make(chan dpm.PluginNameList, 1),
+		Runtime:       string(RuntimeKata),
+	}
+	assert.True(t, l.Update(nil, pfs))
+	assert.Equal(t, dpm.PluginNameList{"1-2-gpu", "gpu"}, <-l.ResUpdateChan)
+	devs := l.NewPlugin("1-2-gpu").(*Plugin).apiDevices()
+	assert.Equal(t, "/dev/vfio/2", devs[0].ID)
+	assert.Len(t, devs, 2)
+}
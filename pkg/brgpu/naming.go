@@ -0,0 +1,194 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// placeholders of the resource name templates
+	gpuPlaceholder   = "{gpu}"
+	modelPlaceholder = "{model}"
+	partsPlaceholder = "{parts}"
+
+	DefaultWholeName = gpuPlaceholder
+	DefaultSplitName = "1-" + partsPlaceholder + "-" + gpuPlaceholder
+
+	// legacyGPUName is the whole card resource before names were
+	// configurable.
+	legacyGPUName = "gpu"
+
+	// sampleModel renders templates for validation.
+	sampleModel = "br104p"
+)
+
+// ResourceNaming names the resources devices are advertised as.
+var ResourceNaming = Naming{Namespace: vendor, Whole: DefaultWholeName, Split: DefaultSplitName}
+
+var (
+	placeholderRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+	invalidModelChars = regexp.MustCompile(`[^a-z0-9]+`)
+	placeholders      = map[string]bool{gpuPlaceholder: true, modelPlaceholder: true, partsPlaceholder: true}
+)
+
+// Naming renders the resources devices are advertised as. Templates may use
+// {gpu} for GPUResourceName, {model} for the product model of the card
+// reported by BRML and {parts} for the number of SVI instances or VFs the
+// card is split into.
+type Naming struct {
+	// Namespace is the resource namespace, like birentech.com.
+	Namespace string
+	// Whole is the template of whole cards, like {gpu} or {model}.
+	Whole string
+	// Split is the template of split cards, like 1-{parts}-{gpu}.
+	Split string
+	// Aliases advertises half of the cards of every renamed resource, rounded
+	// down, under its legacy name gpu or 1-N-gpu, for pods written before the
+	// names changed.
+	Aliases bool
+}
+
+// ValidateNameTemplate reports placeholders a template can not use and
+// names it renders with gpu that are invalid, split templates must use
+// {parts} and whole ones must not.
+func ValidateNameTemplate(tmpl string, gpu string, split bool) error {
+	for _, p := range placeholderRegexp.FindAllString(tmpl, -1) {
+		if !placeholders[p] {
+			return fmt.Errorf("unknown placeholder %s in %q, use %s, %s or %s", p, tmpl, gpuPlaceholder, modelPlaceholder, partsPlaceholder)
+		}
+	}
+	if uses := strings.Contains(tmpl, partsPlaceholder); uses != split {
+		if split {
+			return fmt.Errorf("template %q of split cards needs %s", tmpl, partsPlaceholder)
+		}
+		return fmt.Errorf("template %q of whole cards can not use %s", tmpl, partsPlaceholder)
+	}
+	for _, name := range []string{render(tmpl, gpu, sampleModel, 2), render(tmpl, gpu, sampleModel, 4)} {
+		if msgs := validation.IsDNS1123Label(name); len(msgs) > 0 {
+			return fmt.Errorf("template %q renders invalid name %q: %s", tmpl, name, strings.Join(msgs, ", "))
+		}
+	}
+	return nil
+}
+
+// UsesModel tells whether the names need the product model of the cards.
+func (n Naming) UsesModel() bool {
+	return strings.Contains(n.Whole, modelPlaceholder) || strings.Contains(n.Split, modelPlaceholder)
+}
+
+// name is the resource of a card of model split into parts, parts below 2
+// are whole cards.
+func (n Naming) name(model string, parts int) string {
+	if parts <= 1 {
+		return render(n.Whole, GPUResourceName, model, 1)
+	}
+	return render(n.Split, GPUResourceName, model, parts)
+}
+
+// legacyName is the resource a card split into parts had before resource
+// names were configurable, whatever GPUResourceName is now.
+func legacyName(parts int) string {
+	if parts <= 1 {
+		return legacyGPUName
+	}
+	return fmt.Sprintf("1-%d-%s", parts, legacyGPUName)
+}
+
+// aliasCards returns how many of the cards of a resource take the legacy
+// name, half of them rounded down so that at least one card keeps the new
+// name.
+func aliasCards(cards int) int {
+	return cards / 2
+}
+
+// withAliases gives the first half of the cards of every renamed resource
+// back their legacy name, so that every device is advertised once, under
+// either name. A card is aliased with all its instances.
+func (d DevicesInfoList) withAliases() DevicesInfoList {
+	cards := map[string]int{}
+	for _, v := range d {
+		if len(v.Instances) > 0 && v.Instances[0].ResourceName != legacyName(v.SVICount) {
+			cards[v.Instances[0].ResourceName]++
+		}
+	}
+	aliased := map[string]int{}
+	for i, v := range d {
+		if len(v.Instances) == 0 {
+			continue
+		}
+		resource := v.Instances[0].ResourceName
+		if n, ok := cards[resource]; !ok || aliased[resource] >= aliasCards(n) {
+			continue
+		}
+		aliased[resource]++
+		instances := append([]Instance{}, v.Instances...)
+		for j := range instances {
+			instances[j].ResourceName = legacyName(v.SVICount)
+		}
+		d[i].Instances = instances
+	}
+	return d
+}
+
+// withAliases gives the first half of the PFs of every renamed resource back
+// their legacy name.
+func (p PFDeviceInfoList) withAliases() PFDeviceInfoList {
+	pfs := map[string]int{}
+	for _, v := range p {
+		if len(v.VFs) > 0 && v.VFs[0].ResourceName != legacyName(v.VFCount) {
+			pfs[v.VFs[0].ResourceName]++
+		}
+	}
+	aliased := map[string]int{}
+	for i, v := range p {
+		if len(v.VFs) == 0 {
+			continue
+		}
+		resource := v.VFs[0].ResourceName
+		if n, ok := pfs[resource]; !ok || aliased[resource] >= aliasCards(n) {
+			continue
+		}
+		aliased[resource]++
+		vfs := append([]VFDeviceInfo{}, v.VFs...)
+		for j := range vfs {
+			vfs[j].ResourceName = legacyName(v.VFCount)
+		}
+		p[i].VFs = vfs
+	}
+	return p
+}
+
+// RenderName renders a name template, parts below 2 are whole cards.
+func RenderName(tmpl string, gpu string, model string, parts int) string {
+	return render(tmpl, gpu, model, parts)
+}
+
+func render(tmpl string, gpu string, model string, parts int) string {
+	return strings.NewReplacer(
+		gpuPlaceholder, gpu,
+		modelPlaceholder, model,
+		partsPlaceholder, strconv.Itoa(parts),
+	).Replace(tmpl)
+}
+
+// modelName turns a product name like BR104P into a name part like br104p.
+func modelName(product string) string {
+	return strings.Trim(invalidModelChars.ReplaceAllString(strings.ToLower(product), "-"), "-")
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
+	"github.com/stretchr/testify/assert"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func setNaming(t *testing.T, n Naming) {
+	old := ResourceNaming
+	ResourceNaming = n
+	t.Cleanup(func() { ResourceNaming = old })
+}
+
+func newModelBackend() *FakeBackend {
+	backend := newTestBackend()
+	for i := range backend.Devices {
+		backend.Update(i, func(d *FakeDevice) {
+			d.Product = "BR104P"
+		})
+	}
+	return backend
+}
+
+func TestValidateNameTemplate(t *testing.T) {
+	assert.NoError(t, ValidateNameTemplate(DefaultWholeName, "gpu", false))
+	assert.NoError(t, ValidateNameTemplate(DefaultSplitName, "gpu", true))
+	assert.NoError(t, ValidateNameTemplate("{model}-1of{parts}", "gpu", true))
+	assert.EqualError(t, ValidateNameTemplate("{gpu}-{vfs}", "gpu", true), `unknown placeholder {vfs} in "{gpu}-{vfs}", use {gpu}, {model} or {parts}`)
+	assert.Error(t, ValidateNameTemplate("{model}", "gpu", true))
+	assert.Error(t, ValidateNameTemplate("{gpu}-{parts}", "gpu", false))
+	assert.Error(t, ValidateNameTemplate("{gpu}", "Big_GPU", false))
+	assert.Equal(t, "br104p", modelName(" BR104P "))
+	assert.Equal(t, "br-106-pcie", modelName("BR_106 (PCIe)"))
+}
+
+func TestDeviceDiscoverNaming(t *testing.T) {
+	setNaming(t, Naming{Namespace: "example.com", Whole: "{model}", Split: "{gpu}-1of{parts}"})
+	info, err := DeviceDiscover(newModelBackend())
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"br104p", "gpu-1of2"}, info.ResourceNames())
+	assert.Equal(t, []string{"card_2", "card_3"}, info.FilterByName("gpu-1of2").AllCardIDs())
+	assert.Equal(t, "example.com", (&Lister{}).GetResourceNamespace())
+	assert.Equal(t, "example.com/br104p", genSpec(newModelBackend(), "br104p", false).Kind)
+	assert.Equal(t, "example.com/gpu.", LabelPrefix())
+	assert.Equal(t, "example.com/allocation-policy", PolicyAnnotation())
+}
+
+func TestListerAliases(t *testing.T) {
+	setNaming(t, Naming{Namespace: vendor, Whole: "{model}", Split: DefaultSplitName, Aliases: true})
+	backend := newModelBackend()
+	info, err := DeviceDiscover(backend)
+	assert.NoError(t, err)
+	l := &Lister{
+		ResUpdateChan: make(chan dpm.PluginNameList, 4),
+		Runtime:       string(RuntimeRunc),
+		Backend:       backend,
+	}
+	assert.True(t, l.Update(info, nil))
+	// 1-2-gpu keeps its name and needs no alias
+	assert.Equal(t, dpm.PluginNameList{"1-2-gpu", "br104p", "gpu"}, <-l.ResUpdateChan)
+
+	// the cards are split between the names, each advertised once
+	alias := l.NewPlugin("gpu").(*Plugin)
+	real := l.NewPlugin("br104p").(*Plugin)
+	_, gpus := alias.devices()
+	assert.Equal(t, []string{"card_0"}, gpus.AllCardIDs())
+	_, gpus = real.devices()
+	assert.Equal(t, []string{"card_1"}, gpus.AllCardIDs())
+	assert.Len(t, alias.apiDevices(), 1)
+	assert.Len(t, real.apiDevices(), 1)
+
+	_, err = alias.Allocate(context.Background(), &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"card_1"}},
+	}})
+	assert.Error(t, err)
+
+	// a single card keeps the new name
+	single := DevicesInfoList{{Instances: []Instance{{ResourceName: "br104p", CardID: "card_0"}}, SVICount: 1}}
+	assert.Equal(t, single, append(DevicesInfoList{}, single...).withAliases())
+}
+
+func TestLegacyName(t *testing.T) {
+	old := GPUResourceName
+	GPUResourceName = "biren-gpu"
+	t.Cleanup(func() { GPUResourceName = old })
+	assert.Equal(t, "gpu", legacyName(1))
+	assert.Equal(t, "1-4-gpu", legacyName(4))
+
+	// the cards renamed by GPUResourceName are aliased too
+	d := DevicesInfoList{
+		{Instances: []Instance{{ResourceName: "biren-gpu", CardID: "card_0"}}, SVICount: 1},
+		{Instances: []Instance{{ResourceName: "biren-gpu", CardID: "card_1"}}, SVICount: 1},
+		{Instances: []Instance{{ResourceName: "biren-gpu", CardID: "card_2"}}, SVICount: 1},
+	}.withAliases()
+	assert.Equal(t, "gpu", d[0].Instances[0].ResourceName)
+	assert.Equal(t, "biren-gpu", d[1].Instances[0].ResourceName)
+	assert.Equal(t, "biren-gpu", d[2].Instances[0].ResourceName)
+}
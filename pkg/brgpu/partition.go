@@ -0,0 +1,148 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PartitionWhole = "whole"
+	PartitionHalf  = "1-2"
+	PartitionQuart = "1-4"
+)
+
+var partitionModes = map[string]int{
+	PartitionWhole: 1,
+	PartitionHalf:  2,
+	PartitionQuart: 4,
+}
+
+// PartitionLayout is the SVI mode wanted for the physical cards of a node.
+type PartitionLayout struct {
+	// Mode applies to the cards missing from Cards, 0 leaves them alone.
+	Mode int
+	// Cards maps the index of a physical card to its SVI mode.
+	Cards map[int]int
+}
+
+// ParsePartitionSize parses a GPUPartitionSize like "1-2", or like
+// "whole,0=1-4,3=1-2" where index=size entries set single physical cards.
+func ParsePartitionSize(s string) (PartitionLayout, error) {
+	layout := PartitionLayout{Cards: map[int]int{}}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		index, size := "", part
+		perCard := strings.Contains(part, "=")
+		if perCard {
+			kv := strings.SplitN(part, "=", 2)
+			index, size = kv[0], kv[1]
+		}
+		mode, ok := partitionModes[strings.TrimSpace(size)]
+		if !ok {
+			return PartitionLayout{}, fmt.Errorf("invalid gpu partition size %q, use %s, %s or %s", size, PartitionWhole, PartitionHalf, PartitionQuart)
+		}
+		if !perCard {
+			layout.Mode = mode
+			continue
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(index))
+		if err != nil || i < 0 {
+			return PartitionLayout{}, fmt.Errorf("invalid physical card index %q in gpu partition size", index)
+		}
+		layout.Cards[i] = mode
+	}
+	return layout, nil
+}
+
+// ModeOf returns the SVI mode wanted for the physical card index, 0 when the
+// card is left alone.
+func (l PartitionLayout) ModeOf(index int) int {
+	if mode, ok := l.Cards[index]; ok {
+		return mode
+	}
+	return l.Mode
+}
+
+// ApplyPartition sets the SVI mode of every card to the one in layout. Cards
+// running workloads are left as they are, since changing the mode destroys
+// the instances the workloads run on.
+func ApplyPartition(backend DeviceBackend, layout PartitionLayout) error {
+	count, err := backend.DeviceCount()
+	if err != nil {
+		return err
+	}
+	errs := []string{}
+	for i := 0; i < count; i++ {
+		want := layout.ModeOf(i)
+		if want == 0 {
+			continue
+		}
+		if err := applyCardPartition(backend, i, want); err != nil {
+			log.Errorf("partition physical card %d failed %v", i, err)
+			errs = append(errs, fmt.Sprintf("card %d: %v", i, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("partition cards failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func applyCardPartition(backend DeviceBackend, index int, want int) error {
+	dev, err := backend.HandleByIndex(index)
+	if err != nil {
+		return err
+	}
+	current, err := backend.GetSviMode(dev)
+	if err != nil {
+		return err
+	}
+	if current == want || (current == 0 && want == 1) {
+		return nil
+	}
+
+	processes, err := backend.RunningProcesses(dev)
+	if err != nil {
+		return fmt.Errorf("count running processes: %v", err)
+	}
+	for id := 0; current > 1 && id < current; id++ {
+		ins, err := backend.GetGPUInstanceByID(dev, uint32(id))
+		if err != nil {
+			return fmt.Errorf("lookup svi instance %d: %v", id, err)
+		}
+		n, err := backend.RunningProcesses(ins)
+		if err != nil {
+			return fmt.Errorf("count running processes of svi instance %d: %v", id, err)
+		}
+		processes += n
+	}
+	if processes > 0 {
+		log.Warnf("Physical card %d runs %d processes, keeping svi mode %d instead of %d", index, processes, current, want)
+		return nil
+	}
+
+	if err := backend.SetSviMode(dev, want); err != nil {
+		return err
+	}
+	log.Infof("Physical card %d svi mode changed from %d to %d", index, current, want)
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePartitionSize(t *testing.T) {
+	cases := []struct {
+		in   string
+		want PartitionLayout
+	}{
+		{"", PartitionLayout{Cards: map[int]int{}}},
+		{"1-2", PartitionLayout{Mode: 2, Cards: map[int]int{}}},
+		{"whole, 0=1-4,3=1-2", PartitionLayout{Mode: 1, Cards: map[int]int{0: 4, 3: 2}}},
+		{"1=1-4", PartitionLayout{Cards: map[int]int{1: 4}}},
+	}
+	for _, c := range cases {
+		got, err := ParsePartitionSize(c.in)
+		assert.NoError(t, err, c.in)
+		assert.Equal(t, c.want, got, c.in)
+	}
+	for _, in := range []string{"1-3", "half", "a=1-2", "-1=whole", "0=1-8"} {
+		_, err := ParsePartitionSize(in)
+		assert.Error(t, err, in)
+	}
+
+	layout, _ := ParsePartitionSize("1-4,2=whole")
+	assert.Equal(t, 4, layout.ModeOf(0))
+	assert.Equal(t, 1, layout.ModeOf(2))
+	layout, _ = ParsePartitionSize("2=whole")
+	assert.Equal(t, 0, layout.ModeOf(0))
+}
+
+func TestApplyPartition(t *testing.T) {
+	fb := newTestBackend()
+	layout, err := ParsePartitionSize("1-2,2=whole")
+	assert.NoError(t, err)
+	assert.NoError(t, ApplyPartition(fb, layout))
+
+	info, err := DeviceDiscover(fb)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1-2-gpu", "gpu"}, info.ResourceNames())
+	assert.Equal(t, []string{"card_0", "card_4", "card_1", "card_5"}, info.FilterByName("1-2-gpu").AllCardIDs())
+	assert.Equal(t, []string{"card_2"}, info.FilterByName("gpu").AllCardIDs())
+
+	// busy cards keep their mode
+	fb.Update(0, func(d *FakeDevice) { d.Instances[1].Processes = 1 })
+	fb.Update(1, func(d *FakeDevice) { d.Processes = 2 })
+	layout, _ = ParsePartitionSize("1-4")
+	assert.NoError(t, ApplyPartition(fb, layout))
+	info, err = DeviceDiscover(fb)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1-2-gpu", "1-4-gpu"}, info.ResourceNames())
+	assert.Equal(t, []string{"card_2", "card_6", "card_7", "card_8"}, info.FilterByName("1-4-gpu").AllCardIDs())
+
+	fb.Update(1, func(d *FakeDevice) { d.Lost = true })
+	assert.Error(t, ApplyPartition(fb, layout))
+}
+
+// failingSviBackend fails to set SVI modes, like BRML does without root.
+type failingSviBackend struct {
+	*FakeBackend
+}
+
+func (failingSviBackend) SetSviMode(DeviceHandle, int) error {
+	return errors.New("no permission")
+}
+
+func TestApplyPartitionFails(t *testing.T) {
+	backend := failingSviBackend{newTestBackend()}
+	bgm := NewBrGPUManager("", GPUConfig{GPUPartitionSize: "1-4"}, backend)
+	err := bgm.applyPartition()
+	assert.ErrorContains(t, err, "no permission")
+
+	// cards already in the wanted mode need no change
+	bgm = NewBrGPUManager("", GPUConfig{GPUPartitionSize: "0=whole,1=whole,2=1-2"}, backend)
+	assert.NoError(t, bgm.applyPartition())
+}
@@ -14,14 +14,16 @@
 package brgpu
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/BirenTechnology/go-brml/brml"
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/metrics"
 	"github.com/BirenTechnology/k8s-device-plugin/pkg/utils"
 
 	log "github.com/sirupsen/logrus"
@@ -29,17 +31,25 @@ import (
 )
 
 var (
-	MountHostPath bool
+	// PluginMountPath is where the /usr of the host is mounted in the
+	// plugin container, and where MountHostPath mounts it in containers.
+	PluginMountPath = DefaultPluginMountPath
 )
 
 const (
 	allocatedDeviceEnv = "BR_PHY_CARDS"
+	// the other variables describe the devices of BR_PHY_CARDS in the same
+	// order
+	visibleDevicesEnv   = "BR_VISIBLE_DEVICES"
+	deviceIDStrategyEnv = "BR_DEVICE_ID_STRATEGY"
+	deviceUUIDsEnv      = "BR_DEVICE_UUIDS"
+	physicalIndexesEnv  = "BR_PHYSICAL_INDEXES"
+	sviModesEnv         = "BR_SVI_MODES"
+	deviceMemoryEnv     = "BR_DEVICE_MEMORY"
+
+	DefaultPluginMountPath = "/opt/birentech"
 )
 
-func healthCheck() bool {
-	return true
-}
-
 // int8Slice wraps an []int8 with more functions.
 type int8Slice []int8
 
@@ -62,31 +72,134 @@ func uintPtr(c uint32) *uint {
 }
 
 type Plugin struct {
-	PFDevices      PFDeviceInfoList
-	BRGPUs         DevicesInfoList
+	PFDevices PFDeviceInfoList
+	BRGPUs    DevicesInfoList
+	// NodeGPUs is every card and SVI instance discovered on the node, they
+	// are all mounted when MountAllDevice is set.
+	NodeGPUs       DevicesInfoList
 	Runtime        string
-	Heartbeat      chan bool
+	HealthInterval time.Duration
+	Health         chan<- pluginapi.Device
 	resourceName   string
 	MountAllDevice bool
 	MountDriDevice bool
 	MountHostPath  bool
 	TopoGraph      *utils.Graph
+	Backend        DeviceBackend
+	SVIPolicy      SVIPolicy
+	Policy         Policy
+	PodPolicy      PodPolicyLookup
+	Events         *Events
+	// Replicas is how many times each device is advertised, more than one
+	// lets containers time-slice the device.
+	Replicas int
+	// MemoryUnit is the bytes of card memory each device stands for when
+	// cards are served in memory units.
+	MemoryUnit int64
+
+	health *healthChecker
+	// lastHealth is the last reported health by device ID, it outlives the
+	// device lists rebuilt on changes and new ListAndWatch streams.
+	lastHealth map[string]string
+	healthMu   sync.Mutex
+	stop       chan struct{}
+	// stopOnce guards stop, dpm may stop a plugin more than once.
+	stopOnce *sync.Once
+	changed  chan struct{}
+	mu       sync.RWMutex
+}
+
+// devices returns the device lists currently served by the plugin.
+func (p *Plugin) devices() (PFDeviceInfoList, DevicesInfoList) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.PFDevices, p.BRGPUs
+}
+
+// setDevices replaces the served devices and wakes up ListAndWatch so that
+// kubelet receives the new list.
+func (p *Plugin) setDevices(pfDevices PFDeviceInfoList, brGPUs, nodeGPUs DevicesInfoList) {
+	p.mu.Lock()
+	p.PFDevices = pfDevices
+	p.BRGPUs = brGPUs
+	p.NodeGPUs = nodeGPUs
+	p.mu.Unlock()
+	p.poke()
+}
+
+// poke wakes up ListAndWatch to advertise the devices again.
+func (p *Plugin) poke() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
 }
 
-func (p *Plugin) gpuExist(id string) (bool, error) {
-	for _, v := range p.BRGPUs.AllCardIDs() {
-		if id == v {
-			return true, nil
+func (p *Plugin) nodeGPUs() DevicesInfoList {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.NodeGPUs
+}
+
+func (p *Plugin) topoGraph() *utils.Graph {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.TopoGraph
+}
+
+// instances resolves the advertised IDs of a runc allocation to their cards
+// and instances.
+func (p *Plugin) instances(ids []string) ([]DevicesInfo, []Instance, error) {
+	_, brGPUs := p.devices()
+	cards, instances := []DevicesInfo{}, []Instance{}
+	for _, id := range ids {
+		card, ins, ok := brGPUs.byDeviceID(id)
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown device %s", id)
 		}
+		cards = append(cards, card)
+		instances = append(instances, ins)
 	}
-	return false, nil
+	return cards, instances, nil
 }
 
 func (p *Plugin) Start() error {
+	p.mu.Lock()
+	p.stop = make(chan struct{})
+	p.stopOnce = &sync.Once{}
+	p.mu.Unlock()
+	p.changed = make(chan struct{}, 1)
+	if p.health == nil {
+		p.health = newHealthChecker(p.Backend)
+	}
 	return nil
 }
 
+// setSettings applies settings changed while serving.
+func (p *Plugin) setSettings(s Settings) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Policy = s.Policy
+	p.SVIPolicy = s.SVIPolicy
+	p.MountHostPath = s.MountHostPath
+	p.MountDriDevice = s.MountDriDevice
+	p.MountAllDevice = s.MountAllDevice
+}
+
+// stopped is closed once dpm stopped the plugin.
+func (p *Plugin) stopped() <-chan struct{} {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.stop
+}
+
 func (p *Plugin) Stop() error {
+	p.mu.RLock()
+	stop, once := p.stop, p.stopOnce
+	p.mu.RUnlock()
+	if once != nil {
+		once.Do(func() { close(stop) })
+	}
 	return nil
 }
 
@@ -103,69 +216,114 @@ func (p *Plugin) PreStartContainer(ctx context.Context, r *pluginapi.PreStartCon
 }
 
 func (p *Plugin) GetPreferredAllocation(ctx context.Context, r *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	if p.TopoGraph == nil {
-		return &pluginapi.PreferredAllocationResponse{}, nil
+	defer metrics.ObserveRequest("GetPreferredAllocation", p.resourceName, time.Now(), nil)
+	res := &pluginapi.PreferredAllocationResponse{}
+	if p.Runtime == string(RuntimeKata) {
+		p.ignorePodPolicy(r.ContainerRequests)
+	}
+	if p.MemoryUnit > 0 {
+		for _, req := range r.ContainerRequests {
+			res.ContainerResponses = append(res.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+				DeviceIDs: preferMemory(req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize)),
+			})
+		}
+		return res, nil
+	}
+	if p.Replicas > 1 {
+		for _, req := range r.ContainerRequests {
+			res.ContainerResponses = append(res.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+				DeviceIDs: preferReplicas(req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize)),
+			})
+		}
+		return res, nil
+	}
+	_, brGPUs := p.devices()
+	topo := AllocationTopology{Graph: p.topoGraph(), GPUs: brGPUs}
+	// the topology is built on card IDs
+	reqs := []*pluginapi.ContainerPreferredAllocationRequest{}
+	for _, req := range r.ContainerRequests {
+		reqs = append(reqs, &pluginapi.ContainerPreferredAllocationRequest{
+			AvailableDeviceIDs:   brGPUs.cardIDs(req.AvailableDeviceIDs),
+			MustIncludeDeviceIDs: brGPUs.cardIDs(req.MustIncludeDeviceIDs),
+			AllocationSize:       req.AllocationSize,
+		})
 	}
-	nodes := []*utils.Node{}
-	for _, v := range r.ContainerRequests[0].AvailableDeviceIDs {
-		nodes = append(nodes, &utils.Node{
-			Name: v,
+	for _, devices := range AllocateContainers(p.allocationPolicy(reqs), topo, reqs) {
+		res.ContainerResponses = append(res.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+			DeviceIDs: brGPUs.deviceIDs(devices),
 		})
 	}
+	return res, nil
+}
 
-	newGraph := p.TopoGraph.SelectNodes(nodes)
-
-	devices := Allocate(*newGraph, r.ContainerRequests[0].MustIncludeDeviceIDs, int(r.ContainerRequests[0].AllocationSize))
+// ignorePodPolicy tells that the policy the pod being allocated asks for is
+// not used, VFs have no topology for policies to pick from.
+func (p *Plugin) ignorePodPolicy(reqs []*pluginapi.ContainerPreferredAllocationRequest) {
+	if p.PodPolicy == nil || len(reqs) == 0 {
+		return
+	}
+	sizes := []int{}
+	for _, req := range reqs {
+		sizes = append(sizes, int(req.AllocationSize))
+	}
+	if name := p.PodPolicy(p.resourceName, sizes); name != "" {
+		log.Warningf("Ignoring pod annotation %s=%s for %s, allocation policies do not apply with the kata runtime", PolicyAnnotation(), name, p.resourceName)
+	}
+}
 
-	return &pluginapi.PreferredAllocationResponse{
-		ContainerResponses: []*pluginapi.ContainerPreferredAllocationResponse{
-			{
-				DeviceIDs: devices,
-			},
-		},
-	}, nil
+// allocationPolicy returns the policy the pod being allocated asks for, or
+// the policy of the node.
+func (p *Plugin) allocationPolicy(reqs []*pluginapi.ContainerPreferredAllocationRequest) Policy {
+	p.mu.RLock()
+	policy, sviPolicy := p.Policy, p.SVIPolicy
+	p.mu.RUnlock()
+	if policy == nil {
+		policy = topologyBest{svi: sviPolicy}
+	}
+	if p.PodPolicy == nil || len(reqs) == 0 {
+		return policy
+	}
+	sizes := []int{}
+	for _, req := range reqs {
+		sizes = append(sizes, int(req.AllocationSize))
+	}
+	name := p.PodPolicy(p.resourceName, sizes)
+	if name == "" {
+		return policy
+	}
+	podPolicy, err := NewPolicy(name, sviPolicy)
+	if err != nil {
+		log.Warningf("Ignoring pod annotation %s: %v", PolicyAnnotation(), err)
+		return policy
+	}
+	log.Infof("Using allocation policy %s of pod for %s", podPolicy.Name(), p.resourceName)
+	return podPolicy
 }
 
 func (d *Plugin) GetNumaNode(idx int) (bool, int, error) {
-	dev, err := brml.HandleByIndex(idx)
+	dev, err := d.Backend.HandleByIndex(idx)
 	if err != nil {
 		log.Errorf("parse device id index %v fail %v", idx, err)
 		return false, 0, err
 	}
-	pcie, err := brml.DevicePciInfo(dev)
+	pcie, err := d.Backend.DevicePciInfo(dev)
 	if err != nil {
 		log.Errorf("get device index %v %v pcie info err %v", idx, d, err)
 		return false, 0, err
 	}
 
-	// Discard leading zeros.
-	busID := strings.ToLower(strings.TrimPrefix(int8Slice(pcie.BusId[:]).String(), "0000"))
-	b, err := os.ReadFile(fmt.Sprintf("/sys/bus/pci/devices/%s/numa_node", busID))
-	if err != nil {
-		log.Errorf("read bus file id %v fail %v ", busID, err)
-		return false, 0, nil
-	}
-
-	node, err := strconv.Atoi(string(bytes.TrimSpace(b)))
-	if err != nil {
-		return false, 0, fmt.Errorf("eror parsing value for NUMA node: %v", err)
-	}
-
-	if node < 0 {
-		return false, 0, nil
-	}
-
-	return true, node, nil
+	return numaNode(basePath, sysfsBusID(pcie))
 }
 
-func (p *Plugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+func (p *Plugin) apiDevices() []*pluginapi.Device {
+	pfDevices, brGPUs := p.devices()
 	devs := []*pluginapi.Device{}
 	if p.Runtime == string(RuntimeRunc) {
 		devIDs := []string{}
-		for _, v := range p.BRGPUs {
+		for _, v := range brGPUs {
 			for _, ins := range v.Instances {
 				dev := &pluginapi.Device{
-					ID:     ins.CardID,
+					ID:     ins.deviceID(),
 					Health: pluginapi.Healthy,
 				}
 
@@ -184,19 +342,37 @@ func (p *Plugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListA
 						},
 					}
 				}
-				devs = append(devs, dev)
 				devIDs = append(devIDs, ins.CardID)
+				if p.MemoryUnit > 0 {
+					for u := 0; u < int(int64(ins.Memory)/p.MemoryUnit); u++ {
+						unit := *dev
+						unit.ID = memoryID(ins.deviceID(), u)
+						devs = append(devs, &unit)
+					}
+					continue
+				}
+				if p.Replicas <= 1 {
+					devs = append(devs, dev)
+					continue
+				}
+				for r := 0; r < p.Replicas; r++ {
+					replica := *dev
+					replica.ID = replicaID(ins.deviceID(), r)
+					devs = append(devs, &replica)
+				}
 			}
 
 		}
-		tg, err := Device2Graph(devIDs)
+		tg, err := Device2Graph(p.Backend, devIDs)
 		if err != nil {
 			log.Errorf("Generate gpu %v topo error %v", devIDs, err)
 		}
+		p.mu.Lock()
 		p.TopoGraph = tg
+		p.mu.Unlock()
 	}
 	if p.Runtime == string(RuntimeKata) {
-		for _, v := range p.PFDevices {
+		for _, v := range pfDevices {
 			for _, vf := range v.VFs {
 				dev := &pluginapi.Device{
 					ID:     vf.deviceEndpoint(),
@@ -206,48 +382,212 @@ func (p *Plugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListA
 			}
 		}
 	}
+	return devs
+}
+
+// probe returns nil when the advertised device is usable.
+func (p *Plugin) probe(id string) error {
+	pfDevices, brGPUs := p.devices()
+	if p.Runtime == string(RuntimeKata) {
+		for _, v := range pfDevices {
+			for _, vf := range v.VFs {
+				if vf.deviceEndpoint() == id {
+					return p.health.checkVF(vf)
+				}
+			}
+		}
+		return fmt.Errorf("unknown device %s", id)
+	}
+	if v, ins, ok := brGPUs.byDeviceID(realID(id)); ok {
+		return p.health.checkInstance(v.PhysicalNum, ins.CardID)
+	}
+	return fmt.Errorf("unknown device %s", id)
+}
+
+// updateHealth probes every device and reports whether any changed state.
+// Replicas and memory units of a device share the probe of the device, and
+// a change is reported once for the device. Devices rebuilt as healthy take
+// the last known health, so only real transitions are logged and reported.
+func (p *Plugin) updateHealth(devs []*pluginapi.Device) bool {
+	changed := false
+	probed := map[string]string{}
+	transitions := []pluginapi.Device{}
+	p.healthMu.Lock()
+	if p.lastHealth == nil {
+		p.lastHealth = map[string]string{}
+	}
+	for _, dev := range devs {
+		id := realID(dev.ID)
+		health, ok := probed[id]
+		if !ok {
+			health = pluginapi.Healthy
+			err := p.probe(id)
+			if err != nil {
+				health = pluginapi.Unhealthy
+			}
+			probed[id] = health
+			prev, known := p.lastHealth[id]
+			if !known {
+				prev = pluginapi.Healthy
+			}
+			if prev != health {
+				if err != nil {
+					log.Errorf("Device %s is unhealthy: %v", id, err)
+				} else {
+					log.Infof("Device %s is healthy again", id)
+				}
+				transitions = append(transitions, pluginapi.Device{ID: id, Health: health, Topology: dev.Topology})
+			}
+			p.lastHealth[id] = health
+		}
+		if dev.Health == health {
+			continue
+		}
+		dev.Health = health
+		changed = true
+	}
+	p.healthMu.Unlock()
+	if p.Health != nil {
+		for _, t := range transitions {
+			select {
+			case p.Health <- t:
+			case <-p.stop:
+			}
+		}
+	}
+	return changed
+}
 
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: devs})
+func (p *Plugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	devs := p.apiDevices()
+	p.updateHealth(devs)
+	p.recordDevices(devs)
+	if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devs}); err != nil {
+		return err
+	}
 
-	select {}
+	var tick <-chan time.Time
+	if p.HealthInterval > 0 {
+		ticker := time.NewTicker(p.HealthInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-p.stop:
+			return nil
+		case <-s.Context().Done():
+			return nil
+		case <-p.changed:
+			devs = p.apiDevices()
+			p.updateHealth(devs)
+			log.Infof("Device list changed, advertising %d devices", len(devs))
+			p.recordDevices(devs)
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devs}); err != nil {
+				log.Errorf("send device list failed %v", err)
+				return err
+			}
+		case <-tick:
+			if !p.updateHealth(devs) {
+				continue
+			}
+			p.recordDevices(devs)
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devs}); err != nil {
+				log.Errorf("send device list failed %v", err)
+				return err
+			}
+		}
+	}
 }
 
-func (p *Plugin) Allocate(ctx context.Context, r *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+// recordDevices publishes the advertised devices and their health as metrics.
+func (p *Plugin) recordDevices(devs []*pluginapi.Device) {
+	health := map[string]bool{}
+	for _, dev := range devs {
+		health[dev.ID] = dev.Health == pluginapi.Healthy
+	}
+	metrics.SetDevices(p.resourceName, health)
+}
+
+func (p *Plugin) Allocate(ctx context.Context, r *pluginapi.AllocateRequest) (_ *pluginapi.AllocateResponse, err error) {
+	defer func(start time.Time) {
+		metrics.ObserveRequest("Allocate", p.resourceName, start, err)
+		if err != nil {
+			sizes := []int{}
+			for _, req := range r.ContainerRequests {
+				sizes = append(sizes, len(req.DevicesIDs))
+			}
+			p.Events.AllocationFailed(p.resourceName, sizes, err)
+		}
+	}(time.Now())
+	p.mu.RLock()
+	mountHostPath, mountDriDevice, mountAllDevice := p.MountHostPath, p.MountDriDevice, p.MountAllDevice
+	p.mu.RUnlock()
 	responses := pluginapi.AllocateResponse{}
 	for _, req := range r.ContainerRequests {
 		response := pluginapi.ContainerAllocateResponse{}
+		// replicas and memory units of a device give access to the device
+		ids := realIDs(req.DevicesIDs)
+		envs := map[string]string{}
+		if p.MemoryUnit > 0 {
+			// kubelet picks units of several cards when no card has room
+			// for the request. Moving them to one card would hand out units
+			// of it that kubelet still counts free, so the pod fails
+			// admission instead.
+			if len(ids) > 1 {
+				metrics.AllocationError(p.resourceName, "memory_cards")
+				log.Errorf("Invalid allocation request for %s: memory units %v come from %d cards", p.resourceName, req.DevicesIDs, len(ids))
+				return nil, fmt.Errorf("invalid allocation request for %s: memory units %v come from %d cards, a container gets memory of one card", p.resourceName, req.DevicesIDs, len(ids))
+			}
+			envs[memoryUnitsEnv] = strconv.Itoa(len(req.DevicesIDs))
+			envs[memoryLimitEnv] = strconv.FormatInt(int64(len(req.DevicesIDs))*p.MemoryUnit, 10)
+		}
+		var instances []Instance
+		if p.Runtime == string(RuntimeRunc) {
+			var cards []DevicesInfo
+			cards, instances, err = p.instances(ids)
+			if err != nil {
+				metrics.AllocationError(p.resourceName, "unknown_device")
+				log.Errorf("Invalid allocation request for %s: %v", p.resourceName, err)
+				return nil, fmt.Errorf("invalid allocation request for %s: %v", p.resourceName, err)
+			}
+			for k, v := range deviceEnvs(cards, instances) {
+				envs[k] = v
+			}
+			// the container gets memoryLimitEnv of the card, not all of it
+			if p.MemoryUnit > 0 {
+				delete(envs, deviceMemoryEnv)
+			}
+		}
 		if CdiFeature {
-			for _, id := range req.DevicesIDs {
+			for i, id := range ids {
+				resource := p.getResourceByCardId(ContainerRuntime(p.Runtime), id)
+				if instances != nil {
+					resource = instances[i].ResourceName
+				}
 				response.CDIDevices = append(response.CDIDevices, &pluginapi.CDIDevice{
-					Name: fmt.Sprintf("%s/%s=%s", vendor, p.getResourceByCardId(ContainerRuntime(p.Runtime), id), id),
+					Name: fmt.Sprintf("%s/%s=%s", ResourceNaming.Namespace, resource, id),
 				})
 			}
+			if len(envs) > 0 {
+				response.Envs = envs
+			}
 			responses.ContainerResponses = append(responses.ContainerResponses, &response)
 			continue
 		}
-		if p.MountHostPath {
-			response.Mounts = append(response.Mounts, podMounts()...)
+		if mountHostPath {
+			response.Mounts = append(response.Mounts, podMounts(p.Backend)...)
 		}
 		if p.Runtime == string(RuntimeRunc) {
-			if p.MountDriDevice {
-				driDevs, err := drmDevices()
-				if err != nil {
-					return nil, err
+			cardIDs := []string{}
+			for _, ins := range instances {
+				cardIDs = append(cardIDs, ins.CardID)
+				// every card is mounted below
+				if mountAllDevice {
+					continue
 				}
-				response.Devices = append(response.Devices, driDevs...)
-			}
 
-			for _, id := range req.DevicesIDs {
-				exist, err := p.gpuExist(id)
-				if err != nil {
-					return nil, err
-				}
-				if !exist {
-					log.Errorf("Invalid allocation request for %s: unknown device %s", p.resourceName, id)
-					return nil, fmt.Errorf("invalid allocation request for %s: unknown device %s", p.resourceName, id)
-				}
-
-				devpath := fmt.Sprintf("/dev/biren/%s", id)
+				devpath := fmt.Sprintf("/dev/biren/%s", ins.CardID)
 				dev := pluginapi.DeviceSpec{
 					HostPath:      devpath,
 					ContainerPath: devpath,
@@ -255,7 +595,21 @@ func (p *Plugin) Allocate(ctx context.Context, r *pluginapi.AllocateRequest) (*p
 				}
 
 				response.Devices = append(response.Devices, &dev)
-				log.Infof("Allocate device %s successfully", id)
+				log.Infof("Allocate device %s successfully", ins.deviceID())
+			}
+			if mountAllDevice {
+				allDevs := allDevices(p.nodeGPUs())
+				response.Devices = append(response.Devices, allDevs...)
+				log.Infof("Allocate devices %v with all %d devices successfully", ids, len(allDevs))
+			}
+			if mountDriDevice {
+				driDevs, err := drmDevices(p.Backend, sysClassDrm, cardIDs)
+				if err != nil {
+					metrics.AllocationError(p.resourceName, "dri_devices")
+					log.Errorf("Find render nodes of %v failed %v", cardIDs, err)
+					return nil, err
+				}
+				response.Devices = append(response.Devices, driDevs...)
 			}
 		}
 		if p.Runtime == string(RuntimeKata) {
@@ -269,9 +623,10 @@ func (p *Plugin) Allocate(ctx context.Context, r *pluginapi.AllocateRequest) (*p
 				log.Infof("Allocate device %s successfully", id)
 			}
 		}
-		response.Envs = map[string]string{
-			allocatedDeviceEnv: strings.Join(req.DevicesIDs, ","),
+		if p.Runtime == string(RuntimeKata) {
+			envs[allocatedDeviceEnv] = strings.Join(ids, ",")
 		}
+		response.Envs = envs
 		responses.ContainerResponses = append(responses.ContainerResponses, &response)
 	}
 	//log.Info(responses.ContainerResponses)
@@ -279,12 +634,12 @@ func (p *Plugin) Allocate(ctx context.Context, r *pluginapi.AllocateRequest) (*p
 }
 
 func defaultMountPathFunc(h string) string {
-	return strings.Replace(h, "/usr/", "/opt/birentech/", -1)
+	return strings.Replace(h, "/usr/", strings.TrimSuffix(PluginMountPath, "/")+"/", -1)
 }
 
-func podMounts() []*pluginapi.Mount {
+func podMounts(backend DeviceBackend) []*pluginapi.Mount {
 	mounts := []*pluginapi.Mount{}
-	brmlVersion, _ := brml.BRMLVersion()
+	brmlVersion, _ := backend.Version()
 	mountPaths := map[string]func(string) string{
 		"/usr/lib/libbiren-ml.so":                              defaultMountPathFunc,
 		"/usr/lib/libbiren-ml.so.1":                            defaultMountPathFunc,
@@ -305,40 +660,51 @@ func podMounts() []*pluginapi.Mount {
 	return mounts
 }
 
-func drmDevices() ([]*pluginapi.DeviceSpec, error) {
-	res := []*pluginapi.DeviceSpec{}
-	path := "/dev/dri/renderD128"
-	res = append(res, &pluginapi.DeviceSpec{
-		ContainerPath: path,
-		HostPath:      path,
-		Permissions:   "rw",
-	})
-	return res, nil
-}
-
-func allDevices() ([]*pluginapi.DeviceSpec, error) {
+// allDevices returns the device nodes of every card and SVI instance on the
+// node, for management containers.
+func allDevices(info DevicesInfoList) []*pluginapi.DeviceSpec {
 	res := []*pluginapi.DeviceSpec{}
-	c, err := brml.DeviceCount()
-	if err != nil {
-		return nil, err
-	}
-	for i := 0; i < c; i++ {
-		path := fmt.Sprintf("/dev/biren/card_%d", i)
+	for _, id := range info.AllCardIDs() {
+		path := filepath.Join(deviceBasePath, id)
 		res = append(res, &pluginapi.DeviceSpec{
 			ContainerPath: path,
 			HostPath:      path,
 			Permissions:   "rw",
 		})
 	}
-	return res, nil
+	return res
+}
+
+// deviceEnvs describes allocated instances to the container, every variable
+// lists them in the same order.
+func deviceEnvs(cards []DevicesInfo, instances []Instance) map[string]string {
+	cardIDs, deviceIDs, uuids, indexes, modes, memory := []string{}, []string{}, []string{}, []string{}, []string{}, []string{}
+	for i, ins := range instances {
+		cardIDs = append(cardIDs, ins.CardID)
+		deviceIDs = append(deviceIDs, ins.deviceID())
+		uuids = append(uuids, ins.UUID)
+		indexes = append(indexes, strconv.Itoa(cards[i].PhysicalNum))
+		modes = append(modes, strconv.Itoa(cards[i].SVICount))
+		memory = append(memory, strconv.Itoa(ins.Memory))
+	}
+	return map[string]string{
+		allocatedDeviceEnv:  strings.Join(cardIDs, ","),
+		visibleDevicesEnv:   strings.Join(deviceIDs, ","),
+		deviceIDStrategyEnv: string(IDStrategy),
+		deviceUUIDsEnv:      strings.Join(uuids, ","),
+		physicalIndexesEnv:  strings.Join(indexes, ","),
+		sviModesEnv:         strings.Join(modes, ","),
+		deviceMemoryEnv:     strings.Join(memory, ","),
+	}
 }
 
 func (p *Plugin) getResourceByCardId(runtime ContainerRuntime, id string) string {
+	pfDevices, brGPUs := p.devices()
 	switch runtime {
 	case RuntimeRunc:
-		return p.BRGPUs.getResourceByCardId(id)
+		return brGPUs.getResourceByCardId(id)
 	case RuntimeKata:
-		return p.PFDevices.getResourceByCardId(id)
+		return pfDevices.getResourceByCardId(id)
 	}
-	return "gpu"
+	return GPUResourceName
 }
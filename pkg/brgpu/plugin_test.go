@@ -0,0 +1,135 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func hostPaths(devs []*pluginapi.DeviceSpec) []string {
+	res := []string{}
+	for _, d := range devs {
+		res = append(res, d.HostPath)
+	}
+	return res
+}
+
+func TestAllocateAllDevices(t *testing.T) {
+	backend := newTestBackend()
+	info, err := DeviceDiscover(backend)
+	assert.NoError(t, err)
+	p := &Plugin{
+		Runtime:        string(RuntimeRunc),
+		Backend:        backend,
+		BRGPUs:         info.FilterByName("gpu"),
+		NodeGPUs:       info,
+		resourceName:   "gpu",
+		MountAllDevice: true,
+	}
+	res, err := p.Allocate(context.Background(), &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"card_1"}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/dev/biren/card_0", "/dev/biren/card_1", "/dev/biren/card_2", "/dev/biren/card_3"}, hostPaths(res.ContainerResponses[0].Devices))
+	assert.Equal(t, "card_1", res.ContainerResponses[0].Envs[allocatedDeviceEnv])
+
+	// unknown devices are refused all the same
+	_, err = p.Allocate(context.Background(), &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"card_2"}},
+	}})
+	assert.Error(t, err)
+}
+
+func TestStopTwice(t *testing.T) {
+	p := &Plugin{Runtime: string(RuntimeRunc)}
+	assert.NoError(t, p.Stop())
+	assert.NoError(t, p.Start())
+	assert.NoError(t, p.Stop())
+	assert.NoError(t, p.Stop())
+	<-p.stopped()
+
+	// a restarted plugin is stopped again
+	assert.NoError(t, p.Start())
+	assert.NoError(t, p.Stop())
+	<-p.stopped()
+}
+
+func TestDeviceIDStrategyUUID(t *testing.T) {
+	IDStrategy = DeviceIDUUID
+	defer func() { IDStrategy = DeviceIDIndex }()
+	backend := newTestBackend()
+	info, err := DeviceDiscover(backend)
+	assert.NoError(t, err)
+	p := &Plugin{
+		Runtime:      string(RuntimeRunc),
+		Backend:      backend,
+		BRGPUs:       info.FilterByName("1-2-gpu"),
+		resourceName: "1-2-gpu",
+	}
+	ids := []string{}
+	for _, d := range p.apiDevices() {
+		ids = append(ids, d.ID)
+	}
+	assert.Equal(t, []string{"GPU-2-instance-0", "GPU-2-instance-1"}, ids)
+
+	pref, err := p.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+		{AvailableDeviceIDs: ids, MustIncludeDeviceIDs: []string{"GPU-2-instance-1"}, AllocationSize: 1},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"GPU-2-instance-1"}, pref.ContainerResponses[0].DeviceIDs)
+
+	res, err := p.Allocate(context.Background(), &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"GPU-2-instance-1"}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/dev/biren/card_3"}, hostPaths(res.ContainerResponses[0].Devices))
+	assert.Equal(t, map[string]string{
+		allocatedDeviceEnv:  "card_3",
+		visibleDevicesEnv:   "GPU-2-instance-1",
+		deviceIDStrategyEnv: "uuid",
+		deviceUUIDsEnv:      "GPU-2-instance-1",
+		physicalIndexesEnv:  "2",
+		sviModesEnv:         "2",
+		deviceMemoryEnv:     "34359738368",
+	}, res.ContainerResponses[0].Envs)
+
+	// card IDs are no longer advertised
+	_, err = p.Allocate(context.Background(), &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"card_3"}},
+	}})
+	assert.EqualError(t, err, "invalid allocation request for 1-2-gpu: unknown device card_3")
+
+	CdiFeature = true
+	defer func() { CdiFeature = false }()
+	res, err = p.Allocate(context.Background(), &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"GPU-2-instance-0"}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, "birentech.com/1-2-gpu=GPU-2-instance-0", res.ContainerResponses[0].CDIDevices[0].Name)
+	assert.Equal(t, "card_2", res.ContainerResponses[0].Envs[allocatedDeviceEnv])
+
+	specs, err := runcCDI(backend, nil, false)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, spec := range specs {
+		for _, d := range spec.Devices {
+			names = append(names, d.Name)
+		}
+	}
+	assert.ElementsMatch(t, []string{"GPU-0", "GPU-1", "GPU-2-instance-0", "GPU-2-instance-1"}, names)
+}
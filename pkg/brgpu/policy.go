@@ -0,0 +1,356 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/utils"
+)
+
+const (
+	PolicyTopologyBest = "topology-best"
+	PolicyPack         = "pack"
+	PolicySpread       = "spread"
+	PolicyNUMAStrict   = "numa-strict"
+	PolicyFirstFit     = "first-fit"
+
+	// policyAnnotationName follows the resource namespace in PolicyAnnotation.
+	policyAnnotationName = "allocation-policy"
+)
+
+// PolicyAnnotation overrides the allocation policy for the containers of a
+// pod, it is in the resource namespace.
+func PolicyAnnotation() string {
+	return ResourceNaming.Namespace + "/" + policyAnnotationName
+}
+
+// AllocationTopology is what policies know about the devices of a resource.
+type AllocationTopology struct {
+	// Graph holds the P2P links and locality of the devices, nil when unknown.
+	Graph *utils.Graph
+	GPUs  DevicesInfoList
+}
+
+// Policy picks the devices kubelet is asked to allocate to a container. The
+// result holds must followed by size-len(must) devices of available.
+type Policy interface {
+	Name() string
+	Select(topo AllocationTopology, available []string, must []string, size int) []string
+}
+
+// PolicyNames lists the policies NewPolicy knows.
+func PolicyNames() []string {
+	return []string{PolicyTopologyBest, PolicyPack, PolicySpread, PolicyNUMAStrict, PolicyFirstFit}
+}
+
+// NewPolicy returns the policy called name. svi decides how topology-best
+// picks SVI instances.
+func NewPolicy(name string, svi SVIPolicy) (Policy, error) {
+	switch name {
+	case PolicyTopologyBest, "":
+		return topologyBest{svi: svi}, nil
+	case PolicyPack:
+		return pack{}, nil
+	case PolicySpread:
+		return spread{}, nil
+	case PolicyNUMAStrict:
+		return numaStrict{}, nil
+	case PolicyFirstFit:
+		return firstFitPolicy{}, nil
+	}
+	return nil, fmt.Errorf("unknown allocation policy %q, use one of %s", name, strings.Join(PolicyNames(), ", "))
+}
+
+// topologyBest maximizes the P2P links and locality of whole cards and
+// orders SVI instances by svi.
+type topologyBest struct {
+	svi SVIPolicy
+}
+
+func (p topologyBest) Name() string {
+	return PolicyTopologyBest
+}
+
+func (p topologyBest) Select(topo AllocationTopology, available []string, must []string, size int) []string {
+	if ordered, ok := sviOrder(topo.GPUs, p.svi, available); ok {
+		return firstFit(ordered, must, size)
+	}
+	return selectByGraph(topo.Graph, available, must, size)
+}
+
+func selectByGraph(g *utils.Graph, available []string, must []string, size int) []string {
+	var devices []string
+	if g != nil && size <= len(available) {
+		nodes := []*utils.Node{}
+		for _, id := range available {
+			nodes = append(nodes, &utils.Node{Name: id})
+		}
+		devices = Allocate(*g.SelectNodes(nodes), must, size)
+	}
+	if len(devices) == 0 {
+		devices = firstFit(available, must, size)
+	}
+	return devices
+}
+
+// pack fills partially used cards first so that whole cards stay free. Whole
+// cards are taken from the PCIe switch, or else the NUMA node, with the most
+// cards in use that fits the request, so that whole switches and NUMA nodes
+// stay free for large jobs.
+type pack struct{}
+
+func (p pack) Name() string {
+	return PolicyPack
+}
+
+func (p pack) Select(topo AllocationTopology, available []string, must []string, size int) []string {
+	if ordered, ok := sviOrder(topo.GPUs, SVIPolicyPack, available); ok {
+		return firstFit(ordered, must, size)
+	}
+	if topo.Graph == nil {
+		return firstFit(available, must, size)
+	}
+	for _, key := range []func(utils.NodeAttr) string{switchOf, numaOf} {
+		if group := busiestGroup(topo.Graph, available, must, size, key); group != nil {
+			return selectByGraph(topo.Graph, group, must, size)
+		}
+	}
+	return selectByGraph(topo.Graph, available, must, size)
+}
+
+func switchOf(attr utils.NodeAttr) string {
+	return attr.Switch
+}
+
+func numaOf(attr utils.NodeAttr) string {
+	if attr.NUMA < 0 {
+		return ""
+	}
+	return strconv.Itoa(attr.NUMA)
+}
+
+// busiestGroup groups the cards of g by key and returns the available cards
+// of the group with the most cards in use that has size of them, including
+// must. Ties go to the group with the fewest available cards. It returns nil
+// when no group fits or key is unknown for the cards.
+func busiestGroup(g *utils.Graph, available []string, must []string, size int, key func(utils.NodeAttr) string) []string {
+	free := map[string]bool{}
+	for _, id := range available {
+		free[id] = true
+	}
+	groups, used := map[string][]string{}, map[string]int{}
+	for _, id := range g.NodeNames() {
+		attr, ok := g.NodeAttr(id)
+		if !ok || key(attr) == "" {
+			continue
+		}
+		if free[id] {
+			groups[key(attr)] = append(groups[key(attr)], id)
+		} else {
+			used[key(attr)]++
+		}
+	}
+	best := ""
+	for k, group := range groups {
+		if len(group) < size || !containsAllStrings(group, must) {
+			continue
+		}
+		switch {
+		case best == "",
+			used[k] > used[best],
+			used[k] == used[best] && len(group) < len(groups[best]),
+			used[k] == used[best] && len(group) == len(groups[best]) && k < best:
+			best = k
+		}
+	}
+	if best == "" {
+		return nil
+	}
+	return groups[best]
+}
+
+// spread uses the least used cards first and spreads whole cards over the
+// NUMA nodes.
+type spread struct{}
+
+func (p spread) Name() string {
+	return PolicySpread
+}
+
+func (p spread) Select(topo AllocationTopology, available []string, must []string, size int) []string {
+	if ordered, ok := sviOrder(topo.GPUs, SVIPolicySpread, available); ok {
+		return firstFit(ordered, must, size)
+	}
+	groups, numas := numaGroups(topo.Graph, available)
+	ordered := []string{}
+	for round := 0; len(ordered) < len(available); round++ {
+		for _, numa := range numas {
+			if round < len(groups[numa]) {
+				ordered = append(ordered, groups[numa][round])
+			}
+		}
+	}
+	return firstFit(ordered, must, size)
+}
+
+// numaStrict keeps all devices of a container on one NUMA node, preferring
+// the fullest node that fits. Kubelet treats the answer as a hint only, so
+// when no node fits the devices are picked like topology-best.
+type numaStrict struct{}
+
+func (p numaStrict) Name() string {
+	return PolicyNUMAStrict
+}
+
+func (p numaStrict) Select(topo AllocationTopology, available []string, must []string, size int) []string {
+	groups, numas := numaGroups(topo.Graph, available)
+	best := -1
+	for _, numa := range numas {
+		group := groups[numa]
+		if numa < 0 || len(group) < size || !containsAllStrings(group, must) {
+			continue
+		}
+		if best < 0 || len(group) < len(groups[best]) {
+			best = numa
+		}
+	}
+	if best < 0 {
+		log.Warningf("No NUMA node has %d of the devices %v including %v", size, available, must)
+		return topologyBest{svi: SVIPolicyPack}.Select(topo, available, must, size)
+	}
+	return selectByGraph(topo.Graph, groups[best], must, size)
+}
+
+// firstFitPolicy takes the available devices in the order kubelet sent them.
+type firstFitPolicy struct{}
+
+func (p firstFitPolicy) Name() string {
+	return PolicyFirstFit
+}
+
+func (p firstFitPolicy) Select(topo AllocationTopology, available []string, must []string, size int) []string {
+	return firstFit(available, must, size)
+}
+
+// numaGroups groups devices by the NUMA node recorded in g, -1 holds devices
+// with an unknown NUMA node. The NUMA nodes are returned in ascending order.
+func numaGroups(g *utils.Graph, devices []string) (map[int][]string, []int) {
+	groups := map[int][]string{}
+	for _, id := range devices {
+		numa := -1
+		if g != nil {
+			if attr, ok := g.NodeAttr(id); ok {
+				numa = attr.NUMA
+			}
+		}
+		groups[numa] = append(groups[numa], id)
+	}
+	numas := []int{}
+	for numa := range groups {
+		numas = append(numas, numa)
+	}
+	sort.Ints(numas)
+	return groups, numas
+}
+
+func containsAllStrings(ss []string, sub []string) bool {
+	for _, s := range sub {
+		if !containString(ss, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// PodPolicyLookup returns the policy the pod being allocated asks for
+// through PolicyAnnotation, or "" when it asks for none.
+type PodPolicyLookup func(resource string, sizes []int) string
+
+// NewPodPolicyLookup finds the pod being allocated among the cached pending
+// pods of a node. Device plugins are not told which pod they allocate for,
+// so a pod matches when its containers, or its init containers, request each
+// of sizes devices of resource. This is best effort: pending pods of the same
+// shape can not be told apart, so the annotation is only used when all
+// matching pods agree on it.
+func NewPodPolicyLookup(nodePods *utils.NodePods) PodPolicyLookup {
+	return func(resource string, sizes []int) string {
+		pods, err := nodePods.Pending()
+		if err != nil {
+			log.Errorf("list pending pods failed %v", err)
+			return ""
+		}
+		return podPolicy(pods, resource, sizes)
+	}
+}
+
+func podPolicy(pods []corev1.Pod, resource string, sizes []int) string {
+	policy := ""
+	for i, pod := range matchingPods(pods, resource, sizes) {
+		if i > 0 && pod.Annotations[PolicyAnnotation()] != policy {
+			log.Warningf("Pods pending for %v of %s ask for different allocation policies, using the default", sizes, resource)
+			return ""
+		}
+		policy = pod.Annotations[PolicyAnnotation()]
+	}
+	return policy
+}
+
+// matchingPods returns the pods having a container requesting each of sizes
+// devices of resource.
+func matchingPods(pods []corev1.Pod, resource string, sizes []int) []corev1.Pod {
+	name := corev1.ResourceName(ResourceNaming.Namespace + "/" + resource)
+	res := []corev1.Pod{}
+	for _, pod := range pods {
+		// kubelet allocates init containers and containers separately
+		if coversInts(requests(pod.Spec.Containers, name), sizes) ||
+			coversInts(requests(pod.Spec.InitContainers, name), sizes) {
+			res = append(res, pod)
+		}
+	}
+	return res
+}
+
+// requests returns how many devices of name each container requests.
+func requests(containers []corev1.Container, name corev1.ResourceName) []int {
+	res := []int{}
+	for _, c := range containers {
+		if q, ok := c.Resources.Limits[name]; ok && q.Value() > 0 {
+			res = append(res, int(q.Value()))
+		}
+	}
+	return res
+}
+
+// coversInts reports whether every value of sub is found in a different
+// element of set.
+func coversInts(set []int, sub []int) bool {
+	left := map[int]int{}
+	for _, v := range set {
+		left[v]++
+	}
+	for _, v := range sub {
+		if left[v] == 0 {
+			return false
+		}
+		left[v]--
+	}
+	return true
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/utils"
+)
+
+func TestNewPolicy(t *testing.T) {
+	for _, name := range PolicyNames() {
+		p, err := NewPolicy(name, SVIPolicyPack)
+		assert.NoError(t, err)
+		assert.Equal(t, name, p.Name())
+	}
+	p, err := NewPolicy("", SVIPolicyPack)
+	assert.NoError(t, err)
+	assert.Equal(t, PolicyTopologyBest, p.Name())
+	_, err = NewPolicy("best", SVIPolicyPack)
+	assert.Error(t, err)
+}
+
+// numaGraph returns eight cards on two NUMA nodes where cards 0-3 and 4-7
+// share direct links.
+func numaGraph() *utils.Graph {
+	g := matrixGraph(twoGroupsMatrix)
+	for i := 0; i < 8; i++ {
+		g.SetNodeAttr(cardIDFormat(i), utils.NodeAttr{NUMA: i % 2, Physical: i})
+	}
+	return g
+}
+
+func TestPolicies(t *testing.T) {
+	all := []string{"card_0", "card_1", "card_2", "card_3", "card_4", "card_5", "card_6", "card_7"}
+	cases := []struct {
+		policy    string
+		available []string
+		must      []string
+		size      int
+		want      []string
+	}{
+		// P2P ties inside a group, locality decides
+		{PolicyTopologyBest, all, nil, 2, []string{"card_0", "card_2"}},
+		{PolicyFirstFit, []string{"card_5", "card_2", "card_7"}, nil, 2, []string{"card_5", "card_2"}},
+		{PolicyFirstFit, all, []string{"card_6"}, 2, []string{"card_6", "card_0"}},
+		{PolicySpread, all, nil, 4, []string{"card_0", "card_1", "card_2", "card_3"}},
+		// pack fills the NUMA node with cards in use, the tightest when none is
+		{PolicyPack, all, nil, 2, []string{"card_0", "card_2"}},
+		{PolicyPack, []string{"card_0", "card_2", "card_4", "card_5", "card_6", "card_7"}, nil, 2, []string{"card_5", "card_7"}},
+		{PolicyPack, []string{"card_0", "card_2", "card_3", "card_4", "card_5", "card_6", "card_7"}, nil, 3, []string{"card_3", "card_5", "card_7"}},
+		{PolicyPack, []string{"card_0", "card_2", "card_4", "card_5", "card_6", "card_7"}, []string{"card_0"}, 2, []string{"card_0", "card_2"}},
+		// no NUMA node has four devices left
+		{PolicyPack, []string{"card_0", "card_2", "card_4", "card_5", "card_7"}, nil, 4, []string{"card_0", "card_4", "card_5", "card_7"}},
+		{PolicySpread, []string{"card_0", "card_2", "card_4", "card_5"}, nil, 2, []string{"card_0", "card_5"}},
+		{PolicyNUMAStrict, all, nil, 2, []string{"card_0", "card_2"}},
+		{PolicyNUMAStrict, []string{"card_0", "card_1", "card_3", "card_5", "card_7"}, nil, 2, []string{"card_1", "card_3"}},
+		{PolicyNUMAStrict, []string{"card_0", "card_1", "card_3", "card_4", "card_5", "card_7"}, nil, 2, []string{"card_0", "card_4"}},
+		{PolicyNUMAStrict, all, []string{"card_3"}, 3, []string{"card_1", "card_3", "card_5"}},
+		// no NUMA node has three devices left
+		{PolicyNUMAStrict, []string{"card_0", "card_1", "card_2", "card_5"}, nil, 3, []string{"card_0", "card_1", "card_2"}},
+	}
+	for _, c := range cases {
+		p, err := NewPolicy(c.policy, SVIPolicyPack)
+		assert.NoError(t, err)
+		got := p.Select(AllocationTopology{Graph: numaGraph()}, c.available, c.must, c.size)
+		assert.ElementsMatch(t, c.want, got, "%s from %v", c.policy, c.available)
+	}
+}
+
+func TestPackSwitch(t *testing.T) {
+	g := &utils.Graph{}
+	for i, sw := range []string{"a", "a", "b", "b"} {
+		g.AddNode(&utils.Node{Name: cardIDFormat(i)})
+		g.SetNodeAttr(cardIDFormat(i), utils.NodeAttr{NUMA: 0, Switch: sw})
+	}
+	topo := AllocationTopology{Graph: g}
+	// card_2 is in use
+	assert.Equal(t, []string{"card_3"}, pack{}.Select(topo, []string{"card_0", "card_1", "card_3"}, nil, 1))
+	// switch b has no room for two, switch a does
+	assert.ElementsMatch(t, []string{"card_0", "card_1"}, pack{}.Select(topo, []string{"card_0", "card_1", "card_3"}, nil, 2))
+}
+
+func TestPodPolicy(t *testing.T) {
+	pod := func(name string, policy string, sizes ...int64) corev1.Pod {
+		p := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{}}}
+		if policy != "" {
+			p.Annotations[PolicyAnnotation()] = policy
+		}
+		for _, size := range sizes {
+			p.Spec.Containers = append(p.Spec.Containers, corev1.Container{
+				Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{
+					"birentech.com/gpu": *resource.NewQuantity(size, resource.DecimalSI),
+				}},
+			})
+		}
+		return p
+	}
+
+	pods := []corev1.Pod{pod("a", PolicySpread, 2, 1), pod("b", PolicyPack, 4), pod("c", "", 3)}
+	assert.Equal(t, PolicySpread, podPolicy(pods, "gpu", []int{1}))
+	assert.Equal(t, PolicySpread, podPolicy(pods, "gpu", []int{2}))
+	assert.Equal(t, PolicyPack, podPolicy(pods, "gpu", []int{4}))
+	assert.Equal(t, "", podPolicy(pods, "gpu", []int{3}))
+	assert.Equal(t, "", podPolicy(pods, "gpu", []int{2, 2}))
+	assert.Equal(t, "", podPolicy(pods, "1-2-gpu", []int{1}))
+
+	// ambiguous pods fall back to the node policy
+	pods = append(pods, pod("d", PolicyFirstFit, 4))
+	assert.Equal(t, "", podPolicy(pods, "gpu", []int{4}))
+	pods = append(pods[:3], pod("d", PolicyPack, 4, 2))
+	assert.Equal(t, PolicyPack, podPolicy(pods, "gpu", []int{4}))
+
+	// init containers are allocated on their own
+	e := pod("e", PolicyNUMAStrict, 1)
+	e.Spec.InitContainers, e.Spec.Containers = e.Spec.Containers, []corev1.Container{{}}
+	assert.Equal(t, PolicyNUMAStrict, podPolicy([]corev1.Pod{e}, "gpu", []int{1}))
+}
+
+func TestPluginAllocationPolicy(t *testing.T) {
+	podPolicy := ""
+	p := &Plugin{
+		resourceName: "gpu",
+		TopoGraph:    numaGraph(),
+		Policy:       numaStrict{},
+		PodPolicy: func(resource string, sizes []int) string {
+			assert.Equal(t, "gpu", resource)
+			assert.Equal(t, []int{2}, sizes)
+			return podPolicy
+		},
+	}
+	req := &pluginapi.PreferredAllocationRequest{ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+		AvailableDeviceIDs: []string{"card_0", "card_1", "card_2", "card_3"},
+		AllocationSize:     2,
+	}}}
+
+	for _, c := range []struct {
+		podPolicy string
+		want      []string
+	}{
+		{"", []string{"card_0", "card_2"}},
+		{PolicyFirstFit, []string{"card_0", "card_1"}},
+		{"unknown", []string{"card_0", "card_2"}},
+	} {
+		podPolicy = c.podPolicy
+		res, err := p.GetPreferredAllocation(nil, req)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, c.want, res.ContainerResponses[0].DeviceIDs, "pod policy %q", c.podPolicy)
+	}
+}
@@ -14,18 +14,68 @@
 package brgpu
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/BirenTechnology/go-brml/brml"
 	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
 	log "github.com/sirupsen/logrus"
 )
 
+// Levels of InitTolerateLevel.
+const (
+	// InitFatal stops the plugin when brml fails to initialize.
+	InitFatal = iota
+	// InitRetry retries initializing brml until it succeeds, for nodes
+	// whose driver is loaded after the plugin started.
+	InitRetry
+	// InitRetryDiscovery also retries the first device discovery, for
+	// cards that take a while to come up.
+	InitRetryDiscovery
+)
+
+// initRetryInterval is how often tolerated init failures are retried.
+var initRetryInterval = 10 * time.Second
+
+// GPUResourceName is the resource whole cards are served as, SVI instances
+// and VFs are served as 1-N-<GPUResourceName>, unless ResourceNaming says
+// otherwise.
+var GPUResourceName = "gpu"
+
+// splitResourceName is the legacy resource of cards split into n parts.
+func splitResourceName(n int) string {
+	return fmt.Sprintf("1-%d-%s", n, GPUResourceName)
+}
+
+// DeviceIDStrategy is how runc devices are named to kubelet and in CDI specs.
+type DeviceIDStrategy string
+
+const (
+	// DeviceIDIndex names devices card_N, which changes with reboots and SVI
+	// modes.
+	DeviceIDIndex DeviceIDStrategy = "index"
+	// DeviceIDUUID names devices by their UUID, which SVI instances suffix
+	// with -instance-N.
+	DeviceIDUUID DeviceIDStrategy = "uuid"
+)
+
+// IDStrategy is the device ID strategy of runc mode.
+var IDStrategy = DeviceIDIndex
+
+func ParseDeviceIDStrategy(s string) (DeviceIDStrategy, error) {
+	switch DeviceIDStrategy(s) {
+	case DeviceIDIndex, DeviceIDUUID:
+		return DeviceIDStrategy(s), nil
+	case "":
+		return DeviceIDIndex, nil
+	}
+	return "", fmt.Errorf("unknown device id strategy %q, use %s or %s", s, DeviceIDIndex, DeviceIDUUID)
+}
+
 type Instance struct {
 	UUID         string
 	Memory       int
@@ -33,6 +83,14 @@ type Instance struct {
 	CardID       string
 }
 
+// deviceID is the ID of the instance under IDStrategy.
+func (i Instance) deviceID() string {
+	if IDStrategy == DeviceIDUUID {
+		return i.UUID
+	}
+	return i.CardID
+}
+
 type DevicesInfo struct {
 	PhysicalNum int
 	Instances   []Instance
@@ -41,25 +99,39 @@ type DevicesInfo struct {
 
 type DevicesInfoList []DevicesInfo
 
+// ResourceNames returns the sorted resources of every instance, cards
+// without instances have none.
 func (d DevicesInfoList) ResourceNames() []string {
 	res := []string{}
-	names := map[string]int{}
+	names := map[string]bool{}
 	for _, v := range d {
-		names[v.Instances[0].ResourceName] += 1
-	}
-
-	for k, _ := range names {
-		res = append(res, k)
+		for _, ins := range v.Instances {
+			if !names[ins.ResourceName] {
+				names[ins.ResourceName] = true
+				res = append(res, ins.ResourceName)
+			}
+		}
 	}
+	sort.Strings(res)
 	return res
 }
 
+// FilterByName returns the cards having instances of resourceName, with
+// only those instances.
 func (d DevicesInfoList) FilterByName(resourceName string) DevicesInfoList {
 	res := DevicesInfoList{}
 	for _, v := range d {
-		if v.Instances[0].ResourceName == resourceName {
-			res = append(res, v)
+		instances := []Instance{}
+		for _, ins := range v.Instances {
+			if ins.ResourceName == resourceName {
+				instances = append(instances, ins)
+			}
 		}
+		if len(instances) == 0 {
+			continue
+		}
+		v.Instances = instances
+		res = append(res, v)
 	}
 	return res
 }
@@ -74,6 +146,48 @@ func (d DevicesInfoList) AllCardIDs() []string {
 	return res
 }
 
+// byDeviceID returns the instance advertised as id and its card.
+func (d DevicesInfoList) byDeviceID(id string) (DevicesInfo, Instance, bool) {
+	for _, v := range d {
+		for _, ins := range v.Instances {
+			if ins.deviceID() == id {
+				return v, ins, true
+			}
+		}
+	}
+	return DevicesInfo{}, Instance{}, false
+}
+
+// cardIDs maps advertised device IDs to card IDs, unknown IDs are kept.
+func (d DevicesInfoList) cardIDs(ids []string) []string {
+	res := []string{}
+	for _, id := range ids {
+		if _, ins, ok := d.byDeviceID(id); ok {
+			id = ins.CardID
+		}
+		res = append(res, id)
+	}
+	return res
+}
+
+// deviceIDs maps card IDs to advertised device IDs, unknown IDs are kept.
+func (d DevicesInfoList) deviceIDs(cardIDs []string) []string {
+	ids := map[string]string{}
+	for _, v := range d {
+		for _, ins := range v.Instances {
+			ids[ins.CardID] = ins.deviceID()
+		}
+	}
+	res := []string{}
+	for _, id := range cardIDs {
+		if deviceID, ok := ids[id]; ok {
+			id = deviceID
+		}
+		res = append(res, id)
+	}
+	return res
+}
+
 func (d DevicesInfoList) getResourceByCardId(cardId string) string {
 	for _, vs := range d {
 		for _, v := range vs.Instances {
@@ -82,85 +196,162 @@ func (d DevicesInfoList) getResourceByCardId(cardId string) string {
 			}
 		}
 	}
-	return "gpu"
+	return GPUResourceName
 }
 
-func (bgm *brGPUManager) runcManager(pulse int, mountAllDev bool, mountDriDevice bool) {
-	err := brml.Init()
+func (bgm *brGPUManager) runcManager(ctx context.Context, pulse int, mountAllDev bool, mountDriDevice bool) error {
+	err := bgm.retry(ctx, InitRetry, "brml init", bgm.backend.Init)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
 		log.Errorf("brml init failed %v", err)
-		bgm.Stop <- true
+		return err
 	}
-	defer brml.Shutdown()
+	defer func() {
+		if err := bgm.backend.Shutdown(); err != nil {
+			log.Errorf("brml shutdown failed %v", err)
+		}
+	}()
 
-	info, err := DeviceDiscover()
+	if err := bgm.applyPartition(); err != nil {
+		log.Errorf("gpu partition failed: %v", err)
+		return err
+	}
+	var info DevicesInfoList
+	err = bgm.retry(ctx, InitRetryDiscovery, "runc device discover", func() (err error) {
+		info, err = DeviceDiscover(bgm.backend)
+		return err
+	})
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
 		log.Errorf("runc device discover failed: %v", err)
-		bgm.Stop <- true
+		return err
 	}
+	bgm.Labeler.Reconcile(NodeLabels(bgm.backend, info))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	l := Lister{
-		ResUpdateChan:   make(chan dpm.PluginNameList),
-		Heartbeat:       make(chan bool),
-		MountAllDevice:  mountAllDev,
-		MountDriDevice:  mountDriDevice,
-		DevicesInfoList: info,
-		Runtime:         string(RuntimeRunc),
-		MountHostPath:   MountHostPath,
+		ResUpdateChan:  make(chan dpm.PluginNameList),
+		HealthInterval: bgm.HealthCheckInterval,
+		Health:         bgm.Health,
+		MountAllDevice: mountAllDev,
+		MountDriDevice: mountDriDevice,
+		Runtime:        string(RuntimeRunc),
+		MountHostPath:  bgm.MountHostPath,
+		Backend:        bgm.backend,
+		SVIPolicy:      bgm.SVIPolicy,
+		Policy:         bgm.Policy,
+		PodPolicy:      bgm.PodPolicy,
+		Events:         bgm.Events,
+		Sharing:        bgm.Sharing,
+		Done:           ctx.Done(),
+	}
+	regenerate := func() {
+		if err := bgm.writeCdiSpec(RuntimeRunc, mountDriDevice); err != nil {
+			log.Errorf("runc regenerate cdi config failed %v", err)
+		} else if CdiFeature && OverwriteCdiConfig {
+			bgm.Events.CDISpecRegenerated(RuntimeRunc)
+		}
 	}
+	bgm.setLister(&l, regenerate)
 
-	manager := dpm.NewManager(&l)
+	failed := make(chan error, 1)
 	if pulse > 0 {
 		go func() {
+			ticker := time.NewTicker(time.Second * time.Duration(pulse))
+			defer ticker.Stop()
 			for {
-				time.Sleep(time.Second * time.Duration(pulse))
-				_, err = brml.DeviceCount()
-				if err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				if _, err := bgm.backend.DeviceCount(); err != nil {
 					log.Errorf("Can't find device from host")
-					bgm.Stop <- true
+					failed <- fmt.Errorf("can't find device from host: %v", err)
+					return
 				}
-				l.Heartbeat <- true
 			}
 		}()
 	}
 
+	w := &deviceWatcher{
+		lister:   &l,
+		paths:    []string{deviceBasePath, sysClassBiren},
+		interval: bgm.RediscoverInterval,
+		discover: func() (DevicesInfoList, PFDeviceInfoList, error) {
+			info, err := DeviceDiscover(bgm.backend)
+			return info, nil, err
+		},
+		onChange: regenerate,
+		onDiscover: func(info DevicesInfoList, _ PFDeviceInfoList) {
+			bgm.Labeler.Reconcile(NodeLabels(bgm.backend, info))
+		},
+	}
+	// brml is shut down only after the watcher stopped using it
+	watching := make(chan struct{})
+	defer func() {
+		cancel()
+		<-watching
+	}()
 	go func() {
-		var path = "/sys/class/biren"
-		if _, err := os.Stat(path); err == nil {
-			l.ResUpdateChan <- info.ResourceNames()
-		}
+		defer close(watching)
+		l.Update(info, nil)
+		w.run(ctx.Done())
 	}()
 
-	err = bgm.generateCdiConfigFile(RuntimeRunc)
+	err = bgm.writeCdiSpec(RuntimeRunc, mountDriDevice)
 	if err != nil {
 		log.Errorf("runc generate cdi config failed %v", err)
-		bgm.Stop <- true
+		return err
 	}
 
-	manager.Run()
+	return runPlugins(ctx, &l, failed)
+}
+
+// retry calls f until it succeeds when InitTolerateLevel tolerates level,
+// and once otherwise. It gives up with the error of ctx when ctx is done.
+func (bgm *brGPUManager) retry(ctx context.Context, level int, what string, f func() error) error {
+	for {
+		err := f()
+		if err == nil || bgm.InitTolerateLevel < level {
+			return err
+		}
+		log.Warnf("%s failed %v, retrying in %s", what, err, initRetryInterval)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(initRetryInterval):
+		}
+	}
 }
 
-func DeviceDiscover() (DevicesInfoList, error) {
+func DeviceDiscover(backend DeviceBackend) (DevicesInfoList, error) {
 	dis := DevicesInfoList{}
-	physicalNum, err := brml.DeviceCount()
+	physicalNum, err := backend.DeviceCount()
 	if err != nil {
 		log.Errorf("brml device count err: %v", err)
 		return nil, err
 	}
 
 	for i := 0; i < physicalNum; i++ {
-		log.Infof("discovering device node id %v/%v", i, physicalNum)
-		device, err := brml.HandleByIndex(i)
+		log.Debugf("discovering device node id %v/%v", i, physicalNum)
+		device, err := backend.HandleByIndex(i)
 		if err != nil {
 			log.Errorf("brml HandleByIndex %v err: %v", i, err)
 			return nil, err
 		}
-		sviCount, err := brml.GetSviMode(device)
+		sviCount, err := backend.GetSviMode(device)
 		if err != nil {
 			log.Errorf("brml GetSviMode %v err: %v", device, err)
 			return nil, err
 		}
 
-		phyUUID, err := brml.DeviceUUID(device)
+		phyUUID, err := backend.DeviceUUID(device)
 		if err != nil {
 			log.Errorf("brml DeviceUUID %v err: %v", device, err)
 			return nil, err
@@ -168,15 +359,25 @@ func DeviceDiscover() (DevicesInfoList, error) {
 
 		phyUUID = strings.TrimSpace(phyUUID)
 
+		model := ""
+		if ResourceNaming.UsesModel() {
+			product, err := backend.ProductName(device)
+			if err != nil {
+				log.Errorf("brml ProductName %v err: %v", device, err)
+				return nil, err
+			}
+			model = modelName(product)
+		}
+
 		switch sviCount {
 		case 0, 1:
-			memInfo, err := brml.MemoryInfo(device)
+			memInfo, err := backend.MemoryInfo(device)
 			if err != nil {
 				log.Errorf("brml MemoryInfo %v err: %v", device, err)
 				return nil, err
 			}
 
-			id, err := brml.GetGPUNodeIds(device)
+			id, err := backend.GetGPUNodeIds(device)
 			if err != nil {
 				log.Errorf("brml GetGPUNodeIds %v err: %v", device, err)
 				return nil, err
@@ -187,7 +388,7 @@ func DeviceDiscover() (DevicesInfoList, error) {
 				Instances: []Instance{{
 					UUID:         phyUUID,
 					Memory:       int(memInfo.Total),
-					ResourceName: "gpu",
+					ResourceName: ResourceNaming.name(model, 1),
 					CardID:       cardIDFormat(id),
 				}},
 				SVICount: 1,
@@ -199,19 +400,25 @@ func DeviceDiscover() (DevicesInfoList, error) {
 				SVICount:    sviCount,
 			}
 			for j := 0; j < sviCount; j++ {
-				ins, err := brml.GetGPUInstanceByID(device, uint32(j))
+				ins, err := backend.GetGPUInstanceByID(device, uint32(j))
+				if errors.Is(err, ErrInstanceNotFound) {
+					// a card being split may not report all its instances
+					// yet, the others are still served
+					log.Warnf("brml GetGPUInstanceByID %v/%v err: %v, skip the instance", device, j, err)
+					continue
+				}
 				if err != nil {
 					log.Errorf("brml GetGPUInstanceByID %v/%v err: %v", device, j, err)
 					return nil, err
 				}
 
-				mem, err := brml.MemoryInfo(ins)
+				mem, err := backend.MemoryInfo(ins)
 				if err != nil {
 					log.Errorf("brml MemoryInfo %v err: %v", ins, err)
 					return nil, err
 				}
 
-				id, err := brml.GetGPUNodeIds(ins)
+				id, err := backend.GetGPUNodeIds(ins)
 				if err != nil {
 					log.Errorf("brml GetGPUNodeIds %v err: %v", ins, err)
 					return nil, err
@@ -220,13 +427,21 @@ func DeviceDiscover() (DevicesInfoList, error) {
 				di.Instances = append(di.Instances, Instance{
 					UUID:         fmt.Sprintf("%s-instance-%d", phyUUID, j),
 					Memory:       int(mem.Total),
-					ResourceName: fmt.Sprintf("1-%d-gpu", sviCount),
+					ResourceName: ResourceNaming.name(model, sviCount),
 					CardID:       cardIDFormat(id),
 				})
 			}
+			if len(di.Instances) == 0 {
+				log.Warnf("physical card %d in svi mode %d reports no instances", i, sviCount)
+			}
 			dis = append(dis, di)
+		default:
+			log.Warnf("physical card %d reports unknown svi mode %d, skip it", i, sviCount)
 		}
 	}
+	if ResourceNaming.Aliases {
+		dis = dis.withAliases()
+	}
 	return dis, nil
 }
 
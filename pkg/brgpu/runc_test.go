@@ -0,0 +1,148 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/BirenTechnology/go-brml/brml"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestBackend returns two whole cards and one card split into two SVI
+// instances. Cards 0 and 1 share a direct link.
+func newTestBackend() *FakeBackend {
+	return &FakeBackend{
+		BRMLVersion: "1.0.0",
+		Devices: []FakeDevice{
+			{UUID: "GPU-0", NodeID: 0, Memory: 64 << 30, BusID: "0000:1a:00.0", SviMode: 1},
+			{UUID: "GPU-1", NodeID: 1, Memory: 64 << 30, BusID: "0000:1b:00.0", SviMode: 1},
+			{UUID: "GPU-2", Memory: 64 << 30, BusID: "0000:3d:00.0", SviMode: 2, Instances: []FakeInstance{
+				{NodeID: 2, Memory: 32 << 30},
+				{NodeID: 3, Memory: 32 << 30},
+			}},
+		},
+		P2P: [][]uint32{
+			{0, 2, 1},
+			{2, 0, 1},
+			{1, 1, 2},
+		},
+	}
+}
+
+func TestDeviceDiscover(t *testing.T) {
+	info, err := DeviceDiscover(newTestBackend())
+	assert.NoError(t, err)
+	assert.Equal(t, DevicesInfoList{
+		{
+			PhysicalNum: 0,
+			Instances:   []Instance{{UUID: "GPU-0", Memory: 64 << 30, ResourceName: "gpu", CardID: "card_0"}},
+			SVICount:    1,
+		},
+		{
+			PhysicalNum: 1,
+			Instances:   []Instance{{UUID: "GPU-1", Memory: 64 << 30, ResourceName: "gpu", CardID: "card_1"}},
+			SVICount:    1,
+		},
+		{
+			PhysicalNum: 2,
+			Instances: []Instance{
+				{UUID: "GPU-2-instance-0", Memory: 32 << 30, ResourceName: "1-2-gpu", CardID: "card_2"},
+				{UUID: "GPU-2-instance-1", Memory: 32 << 30, ResourceName: "1-2-gpu", CardID: "card_3"},
+			},
+			SVICount: 2,
+		},
+	}, info)
+
+	assert.ElementsMatch(t, []string{"gpu", "1-2-gpu"}, info.ResourceNames())
+	assert.Equal(t, []string{"card_2", "card_3"}, info.FilterByName("1-2-gpu").AllCardIDs())
+}
+
+// failingMemoryBackend can not read the memory of SVI instances.
+type failingMemoryBackend struct {
+	*FakeBackend
+}
+
+func (f failingMemoryBackend) MemoryInfo(device DeviceHandle) (brml.Memory, error) {
+	if device.(fakeHandle).instance >= 0 {
+		return brml.Memory{}, errors.New("memory info failed")
+	}
+	return f.FakeBackend.MemoryInfo(device)
+}
+
+func TestDeviceDiscoverSVIErrors(t *testing.T) {
+	backend := newTestBackend()
+	// an unknown svi mode skips the card, a missing instance is skipped
+	backend.Update(1, func(d *FakeDevice) { d.SviMode = 3 })
+	backend.Update(2, func(d *FakeDevice) { d.Instances = d.Instances[:1] })
+	info, err := DeviceDiscover(backend)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"card_0", "card_2"}, info.AllCardIDs())
+
+	// other errors of instances fail the discovery
+	_, err = DeviceDiscover(failingMemoryBackend{newTestBackend()})
+	assert.Error(t, err)
+}
+
+func TestDevice2Graph(t *testing.T) {
+	g, err := Device2Graph(newTestBackend(), []string{"card_0", "card_1", "card_2", "card_3"})
+	assert.NoError(t, err)
+
+	_, names := g.MaxValCount(2)
+	assert.ElementsMatch(t, []string{"card_0", "card_1"}, names)
+
+	attr, ok := g.NodeAttr("card_3")
+	assert.True(t, ok)
+	assert.Equal(t, -1, attr.NUMA)
+	assert.Equal(t, 2, attr.Physical)
+
+	_, err = Device2Graph(newTestBackend(), []string{"card_9"})
+	assert.Error(t, err)
+}
+
+func TestInitRetry(t *testing.T) {
+	defer func(d time.Duration) { initRetryInterval = d }(initRetryInterval)
+	initRetryInterval = time.Millisecond
+	failing := func(n int) (func() error, *int) {
+		calls := 0
+		return func() error {
+			calls++
+			if calls <= n {
+				return errors.New("no driver")
+			}
+			return nil
+		}, &calls
+	}
+	bgm := NewBrGPUManager("", GPUConfig{}, newTestBackend())
+
+	f, calls := failing(2)
+	assert.EqualError(t, bgm.retry(context.Background(), InitRetry, "init", f), "no driver")
+	assert.Equal(t, 1, *calls)
+
+	bgm.InitTolerateLevel = InitRetry
+	f, calls = failing(2)
+	assert.NoError(t, bgm.retry(context.Background(), InitRetry, "init", f))
+	assert.Equal(t, 3, *calls)
+	f, calls = failing(2)
+	assert.Error(t, bgm.retry(context.Background(), InitRetryDiscovery, "discover", f))
+	assert.Equal(t, 1, *calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f, _ = failing(2)
+	assert.Equal(t, context.Canceled, bgm.retry(ctx, InitRetry, "init", f))
+}
@@ -0,0 +1,243 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/utils"
+)
+
+const (
+	// idSep joins a card id and the number of a replica or memory unit.
+	idSep = utils.DeviceIDSeparator
+	// replicaSep joins a card id and a replica number, like card_3::r0.
+	replicaSep = idSep + "r"
+	// memorySep joins a card id and a memory unit number, like card_3::m0.
+	memorySep = idSep + "m"
+	// SharedSuffix is appended to the shared resources when they are
+	// renamed, like gpu.shared.
+	SharedSuffix = ".shared"
+	// MaxReplicas bounds the replicas of a device.
+	MaxReplicas = 64
+	// MemorySuffix is appended to the resource of whole cards when they are
+	// served in memory units, like gpu-memory.
+	MemorySuffix = "-memory"
+	// MinMemoryUnit bounds the memory units advertised for a card, 256 for
+	// a card of 64Gi.
+	MinMemoryUnit = 256 << 20
+
+	// memoryLimitEnv and memoryUnitsEnv tell containers the memory they
+	// were given, in bytes and in units.
+	memoryLimitEnv = "BR_GPU_MEMORY_LIMIT"
+	memoryUnitsEnv = "BR_GPU_MEMORY_UNITS"
+)
+
+// Sharing advertises every device of some resources several times, so that
+// as many containers time-slice it.
+type Sharing struct {
+	// Replicas maps resources to how many times each of their devices is
+	// advertised, resources missing from it are not shared.
+	Replicas map[string]int
+	// Rename advertises shared resources with SharedSuffix, so that they
+	// can not be mistaken for exclusive devices.
+	Rename bool
+	// MemoryUnit serves whole cards as the <resource>-memory resource, like
+	// gpu-memory, one device per this many bytes of card memory. Zero serves
+	// whole cards.
+	MemoryUnit int64
+}
+
+// ParseReplicas parses replicas like "gpu=4,1-2-gpu=2".
+func ParseReplicas(s string) (map[string]int, error) {
+	res := map[string]int{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid replicas %q, use resource=count", part)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || n < 1 || n > MaxReplicas {
+			return nil, fmt.Errorf("invalid replica count %q of %s, use 1 to %d", kv[1], kv[0], MaxReplicas)
+		}
+		res[strings.TrimSpace(kv[0])] = n
+	}
+	return res, nil
+}
+
+// ParseMemoryUnit parses a memory unit like "1Gi", empty is zero.
+func ParseMemoryUnit(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(s)
+	if err != nil || q.Sign() <= 0 {
+		return 0, fmt.Errorf("invalid gpu memory unit %q, use a size like 1Gi", s)
+	}
+	if q.Value() < MinMemoryUnit {
+		return 0, fmt.Errorf("gpu memory unit %q is below the minimum of 256Mi", s)
+	}
+	return q.Value(), nil
+}
+
+// replicas returns how many times the devices of resource are advertised.
+func (s Sharing) replicas(resource string) int {
+	if n, ok := s.Replicas[resource]; ok && n > 1 {
+		return n
+	}
+	return 1
+}
+
+// memoryUnit returns the bytes of memory a device stands for, zero when it
+// is not served in memory units. Only whole cards are.
+func (s Sharing) memoryUnit(whole bool) int64 {
+	if whole {
+		return s.MemoryUnit
+	}
+	return 0
+}
+
+// advertised returns the name resource is advertised as, whole tells it is
+// a resource of whole cards.
+func (s Sharing) advertised(resource string, whole bool) string {
+	if s.memoryUnit(whole) > 0 {
+		return resource + MemorySuffix
+	}
+	if s.Rename && s.replicas(resource) > 1 {
+		return resource + SharedSuffix
+	}
+	return resource
+}
+
+func replicaID(id string, replica int) string {
+	return fmt.Sprintf("%s%s%d", id, replicaSep, replica)
+}
+
+func memoryID(id string, unit int) string {
+	return fmt.Sprintf("%s%s%d", id, memorySep, unit)
+}
+
+// realID returns the device a replica or memory unit id stands for.
+func realID(id string) string {
+	if i := strings.Index(id, idSep); i >= 0 {
+		return id[:i]
+	}
+	return id
+}
+
+// realIDs maps replica ids to their devices, each device once.
+func realIDs(ids []string) []string {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		id = realID(id)
+		if !seen[id] {
+			seen[id] = true
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// preferReplicas picks size replicas from available in addition to the
+// ones in must. Each replica comes from the device with the most free
+// replicas, so that as few containers as possible share a device.
+func preferReplicas(available []string, must []string, size int) []string {
+	res := append([]string{}, must...)
+	taken := map[string]bool{}
+	for _, id := range must {
+		taken[id] = true
+	}
+	sorted := append([]string{}, available...)
+	sort.Strings(sorted)
+	free := map[string][]string{}
+	devices := []string{}
+	for _, id := range sorted {
+		if taken[id] {
+			continue
+		}
+		dev := realID(id)
+		if _, ok := free[dev]; !ok {
+			devices = append(devices, dev)
+		}
+		free[dev] = append(free[dev], id)
+	}
+	for len(res) < size {
+		best := ""
+		for _, dev := range devices {
+			if len(free[dev]) > 0 && (best == "" || len(free[dev]) > len(free[best])) {
+				best = dev
+			}
+		}
+		if best == "" {
+			break
+		}
+		res = append(res, free[best][0])
+		free[best] = free[best][1:]
+	}
+	return res
+}
+
+// preferMemory picks size memory units from available in addition to the
+// ones in must, all from one card since a container gets the memory of one
+// card. It picks the card with the fewest free units that fit, so that large
+// requests still find room, and only must when no card fits.
+func preferMemory(available []string, must []string, size int) []string {
+	res := append([]string{}, must...)
+	taken := map[string]bool{}
+	for _, id := range must {
+		taken[id] = true
+	}
+	sorted := append([]string{}, available...)
+	sort.Strings(sorted)
+	free := map[string][]string{}
+	cards := []string{}
+	for _, id := range sorted {
+		if taken[id] {
+			continue
+		}
+		card := realID(id)
+		if _, ok := free[card]; !ok {
+			cards = append(cards, card)
+		}
+		free[card] = append(free[card], id)
+	}
+	// units of must bind the card
+	if len(must) > 0 {
+		cards = []string{realID(must[0])}
+	}
+	need := size - len(res)
+	if need <= 0 {
+		return res
+	}
+	best := ""
+	for _, card := range cards {
+		if n := len(free[card]); n >= need && (best == "" || n < len(free[best])) {
+			best = card
+		}
+	}
+	if best == "" {
+		return res
+	}
+	return append(res, free[best][:need]...)
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
+	"github.com/stretchr/testify/assert"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestParseReplicas(t *testing.T) {
+	replicas, err := ParseReplicas(" gpu=4, 1-2-gpu=2,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"gpu": 4, "1-2-gpu": 2}, replicas)
+
+	replicas, err = ParseReplicas("")
+	assert.NoError(t, err)
+	assert.Empty(t, replicas)
+
+	for _, s := range []string{"gpu", "=4", "gpu=0", "gpu=65", "gpu=many"} {
+		_, err := ParseReplicas(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestPreferReplicas(t *testing.T) {
+	available := []string{"card_0::r0", "card_0::r1", "card_0::r2", "card_1::r0", "card_1::r1"}
+	// replicas come from the least shared cards
+	assert.Equal(t, []string{"card_0::r0", "card_0::r1", "card_1::r0"}, preferReplicas(available, nil, 3))
+	assert.Equal(t, []string{"card_1::r1", "card_0::r0"}, preferReplicas(available, []string{"card_1::r1"}, 2))
+	assert.ElementsMatch(t, available, preferReplicas(available, nil, 9))
+}
+
+func TestListerSharing(t *testing.T) {
+	backend := newTestBackend()
+	info, err := DeviceDiscover(backend)
+	assert.NoError(t, err)
+	l := &Lister{
+		ResUpdateChan: make(chan dpm.PluginNameList, 4),
+		Runtime:       string(RuntimeRunc),
+		Backend:       backend,
+		Sharing:       Sharing{Replicas: map[string]int{"gpu": 2}, Rename: true},
+	}
+	assert.True(t, l.Update(info, nil))
+	assert.Equal(t, dpm.PluginNameList{"1-2-gpu", "gpu.shared"}, <-l.ResUpdateChan)
+
+	p := l.NewPlugin("gpu.shared").(*Plugin)
+	assert.NoError(t, p.Start())
+	defer p.Stop()
+	ids := []string{}
+	for _, dev := range p.apiDevices() {
+		ids = append(ids, dev.ID)
+	}
+	assert.Equal(t, []string{"card_0::r0", "card_0::r1", "card_1::r0", "card_1::r1"}, ids)
+	// replicas are probed as their card
+	assert.Contains(t, p.probe("card_1::r1").Error(), "/dev/biren/card_1 is missing")
+	// and their health changes are reported once per card
+	health := make(chan pluginapi.Device, 4)
+	p.Health = health
+	assert.True(t, p.updateHealth(p.apiDevices()))
+	close(health)
+	reported := []string{}
+	for dev := range health {
+		reported = append(reported, dev.ID)
+	}
+	assert.Equal(t, []string{"card_0", "card_1"}, reported)
+	p.Health = nil
+
+	// replicas of the same card give it once
+	res, err := p.Allocate(context.Background(), &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"card_1::r0", "card_1::r1"}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/dev/biren/card_1"}, hostPaths(res.ContainerResponses[0].Devices))
+	assert.Equal(t, "card_1", res.ContainerResponses[0].Envs[allocatedDeviceEnv])
+
+	// SVI instances are not shared
+	p = l.NewPlugin("1-2-gpu").(*Plugin)
+	assert.Equal(t, 1, p.Replicas)
+	assert.Len(t, p.apiDevices(), 2)
+}
+
+func TestPreferMemory(t *testing.T) {
+	available := []string{
+		"card_0::m0", "card_0::m1", "card_0::m2", "card_0::m3",
+		"card_1::m0", "card_1::m1",
+	}
+	// the card with the fewest free units that fit
+	assert.Equal(t, []string{"card_1::m0", "card_1::m1"}, preferMemory(available, nil, 2))
+	assert.Equal(t, []string{"card_0::m0", "card_0::m1", "card_0::m2"}, preferMemory(available, nil, 3))
+	// units of must keep to their card
+	assert.Equal(t, []string{"card_0::m3", "card_0::m0"}, preferMemory(available, []string{"card_0::m3"}, 2))
+	// no card fits, units of several cards would fail Allocate
+	assert.Empty(t, preferMemory(available, nil, 5))
+	assert.Equal(t, []string{"card_1::m0"}, preferMemory(available, []string{"card_1::m0"}, 3))
+}
+
+func TestListerMemory(t *testing.T) {
+	backend := newTestBackend()
+	info, err := DeviceDiscover(backend)
+	assert.NoError(t, err)
+	l := &Lister{
+		ResUpdateChan: make(chan dpm.PluginNameList, 4),
+		Runtime:       string(RuntimeRunc),
+		Backend:       backend,
+		Sharing:       Sharing{MemoryUnit: 16 << 30},
+	}
+	assert.True(t, l.Update(info, nil))
+	assert.Equal(t, dpm.PluginNameList{"1-2-gpu", "gpu-memory"}, <-l.ResUpdateChan)
+
+	p := l.NewPlugin("gpu-memory").(*Plugin)
+	assert.NoError(t, p.Start())
+	defer p.Stop()
+	assert.Len(t, p.apiDevices(), 8)
+
+	res, err := p.Allocate(context.Background(), &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"card_1::m0", "card_1::m3"}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/dev/biren/card_1"}, hostPaths(res.ContainerResponses[0].Devices))
+	assert.Equal(t, map[string]string{
+		allocatedDeviceEnv:  "card_1",
+		visibleDevicesEnv:   "card_1",
+		deviceIDStrategyEnv: "index",
+		deviceUUIDsEnv:      "GPU-1",
+		physicalIndexesEnv:  "1",
+		sviModesEnv:         "1",
+		memoryUnitsEnv:      "2",
+		memoryLimitEnv:      "34359738368",
+	}, res.ContainerResponses[0].Envs)
+
+	_, err = p.Allocate(context.Background(), &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"card_0::m0", "card_1::m0"}},
+	}})
+	assert.EqualError(t, err, "invalid allocation request for gpu-memory: memory units [card_0::m0 card_1::m0] come from 2 cards, a container gets memory of one card")
+}
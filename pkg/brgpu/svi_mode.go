@@ -0,0 +1,47 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+// go-brml declares brmlDeviceSetSVIMode but does not export it. Like go-brml
+// the symbol is resolved from libbiren-ml, which brml.Init loads globally.
+
+/*
+#cgo LDFLAGS: -Wl,--unresolved-symbols=ignore-in-object-files
+typedef struct brmlDevice_st* brmlDevice_t;
+typedef int brmlReturn_t;
+brmlReturn_t brmlDeviceSetSVIMode(brmlDevice_t device, unsigned int mode, brmlReturn_t* activationStatus);
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/BirenTechnology/go-brml/brml"
+)
+
+// setSviMode splits device into mode SVI instances, mode 1 makes it whole.
+// BRML takes the number of instances as the mode.
+func setSviMode(device brml.Device, mode int) error {
+	var activation C.brmlReturn_t
+	ret := C.brmlDeviceSetSVIMode(*(*C.brmlDevice_t)(unsafe.Pointer(&device)), C.uint(mode), &activation)
+	if brml.Return(ret) != brml.SUCCESS {
+		return errors.New(brml.Error2String(brml.Return(ret)))
+	}
+	if brml.Return(activation) != brml.SUCCESS {
+		return fmt.Errorf("svi mode %d is pending, activating it failed: %s", mode, brml.Error2String(brml.Return(activation)))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package brgpu
+
+import (
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultRediscoverInterval = 60 * time.Second
+	// watchSettleDelay batches the burst of events produced while a card is
+	// re-partitioned or a set of VFs is created.
+	watchSettleDelay = 2 * time.Second
+)
+
+// deviceWatcher rediscovers devices when the watched paths change and on a
+// fixed interval, and hands the result to the lister.
+type deviceWatcher struct {
+	lister   *Lister
+	paths    []string
+	interval time.Duration
+	discover func() (DevicesInfoList, PFDeviceInfoList, error)
+	// onChange is called after the lister received a different device set.
+	onChange func()
+	// onDiscover is called after every successful discovery.
+	onDiscover func(DevicesInfoList, PFDeviceInfoList)
+}
+
+func (w *deviceWatcher) run(stop <-chan struct{}) {
+	var events chan fsnotify.Event
+	var errs chan error
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("create device watcher failed %v, only periodic rediscovery is used", err)
+	} else {
+		defer fsWatcher.Close()
+		events = fsWatcher.Events
+		errs = fsWatcher.Errors
+		for _, p := range w.paths {
+			if err := fsWatcher.Add(p); err != nil {
+				log.Warnf("watch %s failed %v", p, err)
+			}
+		}
+	}
+
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	settle := time.NewTimer(watchSettleDelay)
+	settle.Stop()
+	defer settle.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			log.Debugf("device path event %s", event)
+			settle.Reset(watchSettleDelay)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			// events may have been dropped, rediscover to catch up
+			log.Warnf("device watcher error %v", err)
+			settle.Reset(watchSettleDelay)
+		case <-settle.C:
+			w.sync()
+		case <-tick:
+			w.sync()
+		}
+	}
+}
+
+func (w *deviceWatcher) sync() {
+	info, pfInfo, err := w.discover()
+	if err != nil {
+		log.Errorf("rediscover devices failed %v", err)
+		return
+	}
+	if w.onDiscover != nil {
+		w.onDiscover(info, pfInfo)
+	}
+	if w.lister.Update(info, pfInfo) {
+		log.Info("Device set changed")
+		if w.onChange != nil {
+			w.onChange()
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/brgpu"
+)
+
+const (
+	Version = "v1"
+	// EnvFile names the config file when no flag does.
+	EnvFile = "BIREN_DEVICE_PLUGIN_CONFIG"
+
+	ModePlugin   = "plugin"
+	ModeExporter = "exporter"
+	ModeAll      = "all"
+
+	// reloadDelay batches the events of a file being rewritten, or of a
+	// ConfigMap volume swapping its data directory.
+	reloadDelay = time.Second
+)
+
+// Config is the versioned config file. Intervals are in seconds.
+type Config struct {
+	Version             string     `json:"version"`
+	Mode                string     `json:"mode"`
+	Runtime             string     `json:"runtime"`
+	Pulse               int        `json:"pulse"`
+	HealthCheckInterval int        `json:"healthCheckInterval"`
+	RediscoverInterval  int        `json:"rediscoverInterval"`
+	InitTolerateLevel   int        `json:"initTolerateLevel"`
+	GPUPartitionSize    string     `json:"gpuPartitionSize"`
+	MetricsAddress      string     `json:"metricsAddress"`
+	CDI                 CDI        `json:"cdi"`
+	Mounts              Mounts     `json:"mounts"`
+	Allocation          Allocation `json:"allocation"`
+	Resources           Resources  `json:"resources"`
+	Sharing             Sharing    `json:"sharing"`
+}
+
+type CDI struct {
+	Enabled      bool `json:"enabled"`
+	Overwrite    bool `json:"overwrite"`
+	RemoveOnExit bool `json:"removeOnExit"`
+}
+
+type Mounts struct {
+	// HostPath mounts the Biren libraries and tools of the host.
+	HostPath        bool   `json:"hostPath"`
+	PluginMountPath string `json:"pluginMountPath"`
+	AllDevices      bool   `json:"allDevices"`
+	DRIDevices      bool   `json:"driDevices"`
+}
+
+type Allocation struct {
+	Policy    string `json:"policy"`
+	SVIPolicy string `json:"sviPolicy"`
+}
+
+type Resources struct {
+	// GPUName is the resource of whole cards, split cards are served as
+	// 1-N-<GPUName>.
+	GPUName string `json:"gpuName"`
+	// DeviceIDStrategy names runc devices to kubelet and in CDI specs, index
+	// or uuid.
+	DeviceIDStrategy string `json:"deviceIDStrategy"`
+	// Namespace is the namespace of the resources, like birentech.com.
+	Namespace string `json:"namespace"`
+	// WholeName and SplitName are the templates of the resources of whole
+	// and split cards, they may use {gpu}, {model} and {parts}.
+	WholeName string `json:"wholeName"`
+	SplitName string `json:"splitName"`
+	// Aliases advertises half of the cards of renamed resources, rounded
+	// down, under the names gpu and 1-N-gpu.
+	Aliases bool `json:"aliases"`
+}
+
+// Sharing advertises every device of some resources several times, so that
+// containers time-slice them.
+type Sharing struct {
+	// Replicas is like "gpu=4,1-2-gpu=2".
+	Replicas string `json:"replicas"`
+	// Rename advertises shared resources as <name>.shared.
+	Rename bool `json:"rename"`
+	// MemoryUnit like "1Gi" serves whole cards as <gpuName>-memory in
+	// units of this size.
+	MemoryUnit string `json:"memoryUnit"`
+}
+
+// Load reads the config file at path. Settings missing from the file keep
+// their value in base.
+func Load(path string, base Config) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg, err := Parse(data, base)
+	if err != nil {
+		return Config{}, fmt.Errorf("config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse reads a config from data like Load does.
+func Parse(data []byte, base Config) (Config, error) {
+	cfg := base
+	cfg.Version = ""
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("parse: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// Validate reports every invalid setting of c.
+func (c Config) Validate() error {
+	errs := []string{}
+	add := func(field string, format string, args ...interface{}) {
+		errs = append(errs, field+": "+fmt.Sprintf(format, args...))
+	}
+
+	if c.Version != Version {
+		add("version", "unsupported version %q, use %s", c.Version, Version)
+	}
+	switch c.Mode {
+	case ModePlugin, ModeExporter, ModeAll:
+	default:
+		add("mode", "invalid mode %q, use %s, %s or %s", c.Mode, ModePlugin, ModeExporter, ModeAll)
+	}
+	switch brgpu.ContainerRuntime(c.Runtime) {
+	case brgpu.RuntimeRunc, brgpu.RuntimeKata:
+	default:
+		add("runtime", "invalid runtime %q, use %s or %s", c.Runtime, brgpu.RuntimeRunc, brgpu.RuntimeKata)
+	}
+	for field, v := range map[string]int{
+		"pulse":               c.Pulse,
+		"healthCheckInterval": c.HealthCheckInterval,
+		"rediscoverInterval":  c.RediscoverInterval,
+	} {
+		if v < 0 {
+			add(field, "must not be negative, got %d", v)
+		}
+	}
+	if c.InitTolerateLevel < brgpu.InitFatal || c.InitTolerateLevel > brgpu.InitRetryDiscovery {
+		add("initTolerateLevel", "invalid level %d, use %d to %d", c.InitTolerateLevel, brgpu.InitFatal, brgpu.InitRetryDiscovery)
+	}
+	if _, err := brgpu.ParsePartitionSize(c.GPUPartitionSize); err != nil {
+		add("gpuPartitionSize", "%v", err)
+	}
+	if !filepath.IsAbs(c.Mounts.PluginMountPath) {
+		add("mounts.pluginMountPath", "must be an absolute path, got %q", c.Mounts.PluginMountPath)
+	}
+	if c.CDI.RemoveOnExit && !c.CDI.Enabled {
+		add("cdi.removeOnExit", "needs cdi.enabled")
+	}
+	svi, err := brgpu.ParseSVIPolicy(c.Allocation.SVIPolicy)
+	if err != nil {
+		add("allocation.sviPolicy", "%v", err)
+	}
+	if _, err := brgpu.NewPolicy(c.Allocation.Policy, svi); err != nil {
+		add("allocation.policy", "%v", err)
+	}
+	replicas, err := brgpu.ParseReplicas(c.Sharing.Replicas)
+	if err != nil {
+		add("sharing.replicas", "%v", err)
+	}
+	if unit, err := brgpu.ParseMemoryUnit(c.Sharing.MemoryUnit); err != nil {
+		add("sharing.memoryUnit", "%v", err)
+	} else if whole := brgpu.RenderName(c.Resources.WholeName, c.Resources.GPUName, "", 1); unit > 0 && replicas[whole] > 0 {
+		add("sharing.memoryUnit", "can not be combined with replicas of %s", whole)
+	}
+	if msgs := validation.IsDNS1123Label(c.Resources.GPUName); len(msgs) > 0 {
+		add("resources.gpuName", "invalid name %q: %s", c.Resources.GPUName, strings.Join(msgs, ", "))
+	}
+	if _, err := brgpu.ParseDeviceIDStrategy(c.Resources.DeviceIDStrategy); err != nil {
+		add("resources.deviceIDStrategy", "%v", err)
+	}
+	if msgs := validation.IsDNS1123Subdomain(c.Resources.Namespace); len(msgs) > 0 {
+		add("resources.namespace", "invalid namespace %q: %s", c.Resources.Namespace, strings.Join(msgs, ", "))
+	}
+	if err := brgpu.ValidateNameTemplate(c.Resources.WholeName, c.Resources.GPUName, false); err != nil {
+		add("resources.wholeName", "%v", err)
+	}
+	if err := brgpu.ValidateNameTemplate(c.Resources.SplitName, c.Resources.GPUName, true); err != nil {
+		add("resources.splitName", "%v", err)
+	}
+	naming := brgpu.Naming{Whole: c.Resources.WholeName, Split: c.Resources.SplitName}
+	if naming.UsesModel() && c.Runtime == string(brgpu.RuntimeKata) {
+		add("resources", "the card model is read from BRML, which the kata runtime does not use")
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Watch calls onChange with the config at path every time it changes until
+// ctx is done. Invalid configs are logged and skipped.
+func Watch(ctx context.Context, path string, base Config, current Config, onChange func(Config)) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("watch config %s failed %v, it is not reloaded", path, err)
+		return
+	}
+	defer watcher.Close()
+	// the directory is watched, editors and ConfigMap volumes replace the
+	// file instead of writing it
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		log.Errorf("watch config %s failed %v, it is not reloaded", path, err)
+		return
+	}
+
+	reload := time.NewTimer(reloadDelay)
+	reload.Stop()
+	defer reload.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			log.Debugf("config event %s", event)
+			reload.Reset(reloadDelay)
+		case err, ok := <-watcher.Errors:
+			if ok {
+				log.Errorf("watch config %s failed %v", path, err)
+			}
+		case <-reload.C:
+			cfg, err := Load(path, base)
+			if err != nil {
+				log.Errorf("reload config failed %v, keeping the current one", err)
+				continue
+			}
+			if reflect.DeepEqual(cfg, current) {
+				continue
+			}
+			log.Infof("Config %s changed", path)
+			current = cfg
+			onChange(cfg)
+		}
+	}
+}
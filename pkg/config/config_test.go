@@ -0,0 +1,131 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func base() Config {
+	return Config{
+		Version:             Version,
+		Mode:                ModePlugin,
+		Runtime:             "runc",
+		HealthCheckInterval: 30,
+		RediscoverInterval:  60,
+		Mounts:              Mounts{PluginMountPath: "/opt/birentech"},
+		Allocation:          Allocation{Policy: "topology-best", SVIPolicy: "pack"},
+		Resources:           Resources{GPUName: "gpu", DeviceIDStrategy: "index", Namespace: "birentech.com", WholeName: "{gpu}", SplitName: "1-{parts}-{gpu}"},
+	}
+}
+
+func writeConfig(t *testing.T, path string, data string) {
+	assert.NoError(t, os.WriteFile(path, []byte(data), 0644))
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, `
+version: v1
+runtime: kata
+cdi:
+  enabled: true
+mounts:
+  driDevices: true
+allocation:
+  policy: spread
+`)
+	cfg, err := Load(path, base())
+	assert.NoError(t, err)
+	want := base()
+	want.Runtime = "kata"
+	want.CDI.Enabled = true
+	want.Mounts.DRIDevices = true
+	want.Allocation.Policy = "spread"
+	assert.Equal(t, want, cfg)
+
+	// JSON is YAML too
+	writeConfig(t, path, `{"version": "v1", "pulse": 5}`)
+	cfg, err = Load(path, base())
+	assert.NoError(t, err)
+	assert.Equal(t, 5, cfg.Pulse)
+
+	for _, c := range []struct {
+		data string
+		err  string
+	}{
+		{`pulse: 5`, `version: unsupported version ""`},
+		{"version: v1\nallocation:\n  polcy: pack", `unknown field "polcy"`},
+		{"version: v2\nmode: daemon", `mode: invalid mode "daemon", use plugin, exporter or all; version: unsupported version "v2", use v1`},
+		{"version: v1\nrediscoverInterval: -1\nresources:\n  gpuName: Big_GPU", `rediscoverInterval: must not be negative, got -1; resources.gpuName: invalid name "Big_GPU"`},
+		{"version: v1\nallocation:\n  policy: random", `allocation.policy: unknown allocation policy "random"`},
+		{"version: v1\ngpuPartitionSize: 1-3", `gpuPartitionSize: invalid gpu partition size "1-3"`},
+		{"version: v1\ncdi:\n  removeOnExit: true", `cdi.removeOnExit: needs cdi.enabled`},
+		{"version: v1\nsharing:\n  replicas: gpu=2\n  memoryUnit: 1Gi", `sharing.memoryUnit: can not be combined with replicas of gpu`},
+		{"version: v1\nsharing:\n  memoryUnit: -1Gi", `sharing.memoryUnit: invalid gpu memory unit "-1Gi"`},
+		{"version: v1\nsharing:\n  memoryUnit: 1Mi", `sharing.memoryUnit: gpu memory unit "1Mi" is below the minimum of 256Mi`},
+		{"version: v1\nresources:\n  deviceIDStrategy: serial", `resources.deviceIDStrategy: unknown device id strategy "serial", use index or uuid`},
+		{"version: v1\nresources:\n  namespace: Biren", `resources.namespace: invalid namespace "Biren"`},
+		{"version: v1\nresources:\n  wholeName: \"{model}-{parts}\"\n  splitName: \"{gpu}-{vfs}\"", `resources.splitName: unknown placeholder {vfs} in "{gpu}-{vfs}", use {gpu}, {model} or {parts}; resources.wholeName: template "{model}-{parts}" of whole cards can not use {parts}`},
+		{"version: v1\nresources:\n  splitName: \"{gpu}\"", `resources.splitName: template "{gpu}" of split cards needs {parts}`},
+		{"version: v1\nresources:\n  wholeName: \"{model}.gpu\"", `resources.wholeName: template "{model}.gpu" renders invalid name "br104p.gpu"`},
+		{"version: v1\nruntime: kata\nresources:\n  wholeName: \"{model}\"", `resources: the card model is read from BRML, which the kata runtime does not use`},
+		{"version: v1\nresources:\n  wholeName: br\nsharing:\n  replicas: br=2\n  memoryUnit: 1Gi", `sharing.memoryUnit: can not be combined with replicas of br`},
+		{"version: v1\ninitTolerateLevel: 3\nmounts:\n  pluginMountPath: opt", `initTolerateLevel: invalid level 3, use 0 to 2; mounts.pluginMountPath: must be an absolute path, got "opt"`},
+	} {
+		writeConfig(t, path, c.data)
+		_, err := Load(path, base())
+		if assert.Error(t, err, c.data) {
+			assert.Contains(t, err.Error(), c.err)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "version: v1\n")
+	current, err := Load(path, base())
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan Config, 4)
+	go Watch(ctx, path, base(), current, func(cfg Config) {
+		changes <- cfg
+	})
+	// give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	// invalid configs are skipped
+	writeConfig(t, path, "version: v1\nallocation:\n  policy: random\n")
+	time.Sleep(2 * reloadDelay)
+	assert.Len(t, changes, 0)
+
+	// the file is replaced like a ConfigMap volume does
+	tmp := path + ".tmp"
+	writeConfig(t, tmp, "version: v1\nallocation:\n  policy: spread\n")
+	assert.NoError(t, os.Rename(tmp, path))
+	select {
+	case cfg := <-changes:
+		assert.Equal(t, "spread", cfg.Allocation.Policy)
+	case <-time.After(5 * reloadDelay):
+		t.Fatal("config change not seen")
+	}
+}
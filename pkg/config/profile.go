@@ -0,0 +1,102 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/utils"
+)
+
+const (
+	// profileLabelName follows the resource namespace in ProfileLabel.
+	profileLabelName = "device-plugin.config"
+	// DefaultProfile is used by the nodes without the profile label.
+	DefaultProfile = "default"
+)
+
+// ProfileLabel on a node names the profile of the ConfigMap it uses, it is
+// in the resource namespace.
+func ProfileLabel(namespace string) string {
+	return namespace + "/" + profileLabelName
+}
+
+// Profile returns the profile selected by the node labels from data, which
+// holds a config per profile name, and its config laid over base. The label
+// is in the resource namespace of base. Nodes without the label use
+// DefaultProfile, or base when there is none.
+func Profile(data map[string]string, labels map[string]string, base Config) (string, Config, error) {
+	name, ok := labels[ProfileLabel(base.Resources.Namespace)]
+	if !ok {
+		if _, ok := data[DefaultProfile]; !ok {
+			return "", base, nil
+		}
+		name = DefaultProfile
+	}
+	profile, ok := data[name]
+	if !ok {
+		return name, Config{}, fmt.Errorf("profile %q not found", name)
+	}
+	cfg, err := Parse([]byte(profile), base)
+	if err != nil {
+		return name, Config{}, fmt.Errorf("profile %q: %v", name, err)
+	}
+	return name, cfg, nil
+}
+
+// WatchProfile returns the config of the profile node uses from the
+// ConfigMap namespace/name, and calls onChange with the config every time
+// the ConfigMap or the profile of the node changes until ctx is done.
+// Invalid profiles are logged and skipped once serving.
+func WatchProfile(ctx context.Context, client utils.Client, node string, namespace string, name string, base Config, onChange func(Config)) (Config, error) {
+	var mu sync.Mutex
+	synced := false
+	var current Config
+	var lastErr error
+	err := client.WatchNodeConfigMap(ctx.Done(), node, namespace, name, func(labels map[string]string, data map[string]string) {
+		profile, cfg, err := Profile(data, labels, base)
+		mu.Lock()
+		defer mu.Unlock()
+		if !synced {
+			current, lastErr = cfg, err
+			return
+		}
+		if err != nil {
+			log.Errorf("configmap %s/%s: %v, keeping the current config", namespace, name, err)
+			return
+		}
+		if reflect.DeepEqual(cfg, current) {
+			return
+		}
+		log.Infof("Config profile %q of configmap %s/%s changed", profile, namespace, name)
+		current = cfg
+		onChange(cfg)
+	})
+	if err != nil {
+		return Config{}, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	synced = true
+	if lastErr != nil {
+		return Config{}, fmt.Errorf("configmap %s/%s: %v", namespace, name, lastErr)
+	}
+	return current, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/utils"
+)
+
+var profiles = map[string]string{
+	"default": "version: v1\nallocation:\n  policy: spread\n",
+	"kata":    "version: v1\nruntime: kata\n",
+	"broken":  "version: v1\nruntime: docker\n",
+}
+
+func TestProfile(t *testing.T) {
+	name, cfg, err := Profile(profiles, nil, base())
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultProfile, name)
+	assert.Equal(t, "spread", cfg.Allocation.Policy)
+
+	name, cfg, err = Profile(profiles, map[string]string{ProfileLabel("birentech.com"): "kata"}, base())
+	assert.NoError(t, err)
+	assert.Equal(t, "kata", name)
+	assert.Equal(t, "kata", cfg.Runtime)
+	assert.Equal(t, "topology-best", cfg.Allocation.Policy)
+
+	// no default profile keeps base
+	name, cfg, err = Profile(map[string]string{"kata": profiles["kata"]}, nil, base())
+	assert.NoError(t, err)
+	assert.Equal(t, "", name)
+	assert.Equal(t, base(), cfg)
+
+	_, _, err = Profile(profiles, map[string]string{ProfileLabel("birentech.com"): "gpu-heavy"}, base())
+	assert.EqualError(t, err, `profile "gpu-heavy" not found`)
+	_, _, err = Profile(profiles, map[string]string{ProfileLabel("birentech.com"): "broken"}, base())
+	assert.EqualError(t, err, `profile "broken": runtime: invalid runtime "docker", use runc or kata`)
+
+	// the label follows the resource namespace
+	other := base()
+	other.Resources.Namespace = "example.com"
+	name, _, err = Profile(profiles, map[string]string{ProfileLabel("example.com"): "kata"}, other)
+	assert.NoError(t, err)
+	assert.Equal(t, "kata", name)
+	name, _, err = Profile(profiles, map[string]string{ProfileLabel("birentech.com"): "kata"}, other)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultProfile, name)
+}
+
+func TestWatchProfile(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "profiles", Namespace: "biren-gpu"},
+		Data:       profiles,
+	}
+	client := utils.Client{K8s: fake.NewSimpleClientset(node, cm)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := make(chan Config, 4)
+	cfg, err := WatchProfile(ctx, client, "node1", "biren-gpu", "profiles", base(), func(cfg Config) {
+		changes <- cfg
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "spread", cfg.Allocation.Policy)
+
+	// invalid profiles are skipped
+	node.Labels = map[string]string{ProfileLabel("birentech.com"): "broken"}
+	_, err = client.K8s.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, changes, 0)
+
+	// relabeling the node switches the profile
+	node.Labels = map[string]string{ProfileLabel("birentech.com"): "kata"}
+	_, err = client.K8s.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	select {
+	case cfg := <-changes:
+		assert.Equal(t, "kata", cfg.Runtime)
+	case <-time.After(5 * time.Second):
+		t.Fatal("profile change not seen")
+	}
+
+	// so does changing the profile
+	cm.Data = map[string]string{"kata": "version: v1\nruntime: kata\npulse: 5\n"}
+	_, err = client.K8s.CoreV1().ConfigMaps("biren-gpu").Update(ctx, cm, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	select {
+	case cfg := <-changes:
+		assert.Equal(t, 5, cfg.Pulse)
+	case <-time.After(5 * time.Second):
+		t.Fatal("profile change not seen")
+	}
+
+	// a node selecting a broken profile does not start
+	_, err = WatchProfile(ctx, utils.Client{K8s: fake.NewSimpleClientset(node, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "profiles", Namespace: "biren-gpu"},
+		Data:       map[string]string{"kata": profiles["broken"]},
+	})}, "node1", "biren-gpu", "profiles", base(), func(Config) {})
+	assert.EqualError(t, err, `configmap biren-gpu/profiles: profile "kata": runtime: invalid runtime "docker", use runc or kata`)
+}
@@ -0,0 +1,186 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	namespace = "birentech"
+	subsystem = "device_plugin"
+
+	resultSuccess = "success"
+	resultError   = "error"
+)
+
+var (
+	advertisedDevices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "advertised_devices",
+		Help:      "Number of devices advertised to kubelet per resource.",
+	}, []string{"resource"})
+	deviceHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "device_healthy",
+		Help:      "Whether an advertised device is healthy (1) or unhealthy (0).",
+	}, []string{"resource", "card_id"})
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "requests_total",
+		Help:      "Number of kubelet requests served per method, resource and result.",
+	}, []string{"method", "resource", "result"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "request_duration_seconds",
+		Help:      "Time spent serving kubelet requests per method and resource.",
+		Buckets:   []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"method", "resource"})
+	allocationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "allocation_errors_total",
+		Help:      "Number of failed allocations per resource and reason.",
+	}, []string{"resource", "reason"})
+	cdiGenerations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "cdi_spec_generations_total",
+		Help:      "Number of CDI spec generations per result.",
+	}, []string{"result"})
+	cdiLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "cdi_spec_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful CDI spec generation.",
+	})
+	podDeviceAllocation = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "pod_device_allocation",
+		Help:      "Set to 1 for every device held by a container, to join device metrics on card_id.",
+	}, []string{"resource", "card_id", "namespace", "pod", "container"})
+)
+
+// mux serves /metrics and the debug endpoints added with Handle.
+var mux = http.NewServeMux()
+
+// Registry holds the plugin metrics and the Go and process collectors.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		advertisedDevices,
+		deviceHealthy,
+		requests,
+		requestDuration,
+		allocationErrors,
+		cdiGenerations,
+		cdiLastSuccess,
+		podDeviceAllocation,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	mux.Handle("/metrics", Handler())
+}
+
+// SetDevices records the devices advertised for resource, mapping each
+// device ID to whether it is healthy. Devices no longer advertised are
+// dropped.
+func SetDevices(resource string, devices map[string]bool) {
+	deviceHealthy.DeletePartialMatch(prometheus.Labels{"resource": resource})
+	advertisedDevices.WithLabelValues(resource).Set(float64(len(devices)))
+	for id, healthy := range devices {
+		v := 0.0
+		if healthy {
+			v = 1
+		}
+		deviceHealthy.WithLabelValues(resource, id).Set(v)
+	}
+}
+
+// DeleteResource drops the metrics of a resource that is no longer served.
+func DeleteResource(resource string) {
+	advertisedDevices.DeleteLabelValues(resource)
+	deviceHealthy.DeletePartialMatch(prometheus.Labels{"resource": resource})
+}
+
+// ObserveRequest records a kubelet request that started at start.
+func ObserveRequest(method string, resource string, start time.Time, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = resultError
+	}
+	requests.WithLabelValues(method, resource, result).Inc()
+	requestDuration.WithLabelValues(method, resource).Observe(time.Since(start).Seconds())
+}
+
+// AllocationError counts an allocation that failed for reason.
+func AllocationError(resource string, reason string) {
+	allocationErrors.WithLabelValues(resource, reason).Inc()
+}
+
+// CDIGeneration records the outcome of a CDI spec generation.
+func CDIGeneration(err error) {
+	if err != nil {
+		cdiGenerations.WithLabelValues(resultError).Inc()
+		return
+	}
+	cdiGenerations.WithLabelValues(resultSuccess).Inc()
+	cdiLastSuccess.SetToCurrentTime()
+}
+
+// PodDevice is a device held by a container.
+type PodDevice struct {
+	Resource  string
+	DeviceID  string
+	Namespace string
+	Pod       string
+	Container string
+}
+
+// SetPodDevices replaces the devices held by containers.
+func SetPodDevices(devices []PodDevice) {
+	podDeviceAllocation.Reset()
+	for _, d := range devices {
+		podDeviceAllocation.WithLabelValues(d.Resource, d.DeviceID, d.Namespace, d.Pod, d.Container).Set(1)
+	}
+}
+
+// Handle adds a handler next to /metrics, it has to be called before Serve.
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
+// Handler serves the metrics in Registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Serve serves /metrics and the added handlers on address until the listener
+// fails.
+func Serve(address string) error {
+	log.Infof("Serving metrics on %s", address)
+	return http.ListenAndServe(address, mux)
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetDevices(t *testing.T) {
+	SetDevices("1-2-gpu", map[string]bool{"card_0": true, "card_1": false})
+	assert.Equal(t, 2.0, testutil.ToFloat64(advertisedDevices.WithLabelValues("1-2-gpu")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(deviceHealthy.WithLabelValues("1-2-gpu", "card_0")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(deviceHealthy.WithLabelValues("1-2-gpu", "card_1")))
+
+	SetDevices("1-2-gpu", map[string]bool{"card_0": true})
+	assert.Equal(t, 1.0, testutil.ToFloat64(advertisedDevices.WithLabelValues("1-2-gpu")))
+	assert.Equal(t, 1, testutil.CollectAndCount(deviceHealthy))
+
+	DeleteResource("1-2-gpu")
+	assert.Equal(t, 0, testutil.CollectAndCount(advertisedDevices))
+	assert.Equal(t, 0, testutil.CollectAndCount(deviceHealthy))
+}
+
+func TestRequestsAndErrors(t *testing.T) {
+	ObserveRequest("Allocate", "gpu", time.Now(), nil)
+	ObserveRequest("Allocate", "gpu", time.Now(), errors.New("unknown device"))
+	AllocationError("gpu", "unknown_device")
+	assert.Equal(t, 1.0, testutil.ToFloat64(requests.WithLabelValues("Allocate", "gpu", resultSuccess)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(requests.WithLabelValues("Allocate", "gpu", resultError)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(allocationErrors.WithLabelValues("gpu", "unknown_device")))
+
+	CDIGeneration(nil)
+	CDIGeneration(errors.New("write failed"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(cdiGenerations.WithLabelValues(resultSuccess)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(cdiGenerations.WithLabelValues(resultError)))
+	assert.InDelta(t, float64(time.Now().Unix()), testutil.ToFloat64(cdiLastSuccess), 5)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	assert.Contains(t, string(body), `birentech_device_plugin_request_duration_seconds_count{method="Allocate",resource="gpu"} 2`)
+	assert.Contains(t, string(body), "go_goroutines")
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metrics
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const telemetrySubsystem = "gpu"
+
+var (
+	deviceLabels = []string{"card_id", "uuid", "physical_num", "resource", "namespace", "pod", "container"}
+	cardLabels   = []string{"uuid", "physical_num", "resource"}
+
+	gpuUtilization = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: telemetrySubsystem,
+		Name:      "utilization_percent",
+		Help:      "GPU utilization of a card or SVI instance.",
+	}, deviceLabels)
+	memoryUtilization = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: telemetrySubsystem,
+		Name:      "memory_utilization_percent",
+		Help:      "Memory utilization of a card or SVI instance.",
+	}, deviceLabels)
+	memoryUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: telemetrySubsystem,
+		Name:      "memory_used_bytes",
+		Help:      "Memory used on a card or SVI instance.",
+	}, deviceLabels)
+	memoryTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: telemetrySubsystem,
+		Name:      "memory_total_bytes",
+		Help:      "Memory of a card or SVI instance.",
+	}, deviceLabels)
+	temperature = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: telemetrySubsystem,
+		Name:      "temperature_celsius",
+		Help:      "GPU temperature of a physical card.",
+	}, cardLabels)
+	powerUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: telemetrySubsystem,
+		Name:      "power_usage_watts",
+		Help:      "Power draw of a physical card.",
+	}, cardLabels)
+)
+
+// telemetrySeries are the label values last set on every telemetry vector.
+var (
+	telemetryMu     sync.Mutex
+	telemetrySeries = map[*prometheus.GaugeVec]map[string][]string{}
+)
+
+func init() {
+	Registry.MustRegister(gpuUtilization, memoryUtilization, memoryUsed, memoryTotal, temperature, powerUsage)
+}
+
+// DeviceSample holds the telemetry of a card or an SVI instance. Nil values
+// could not be read and are not exported.
+type DeviceSample struct {
+	CardID      string
+	UUID        string
+	PhysicalNum int
+	Resource    string
+	// Namespace, Pod and Container hold the device, empty when it is free.
+	Namespace string
+	Pod       string
+	Container string
+
+	GPUUtilization    *float64
+	MemoryUtilization *float64
+	MemoryUsedBytes   *float64
+	MemoryTotalBytes  *float64
+}
+
+// CardSample holds the telemetry shared by all instances of a physical card.
+type CardSample struct {
+	UUID        string
+	PhysicalNum int
+	Resource    string
+
+	TemperatureCelsius *float64
+	PowerWatts         *float64
+}
+
+// SetTelemetry replaces the exported telemetry with the given samples. The
+// series of devices that went away are deleted, the others are updated in
+// place so that scrapes never see them missing.
+func SetTelemetry(devices []DeviceSample, cards []CardSample) {
+	telemetryMu.Lock()
+	defer telemetryMu.Unlock()
+	seen := map[*prometheus.GaugeVec]map[string][]string{}
+	for _, d := range devices {
+		labels := []string{d.CardID, d.UUID, strconv.Itoa(d.PhysicalNum), d.Resource, d.Namespace, d.Pod, d.Container}
+		set(seen, gpuUtilization, labels, d.GPUUtilization)
+		set(seen, memoryUtilization, labels, d.MemoryUtilization)
+		set(seen, memoryUsed, labels, d.MemoryUsedBytes)
+		set(seen, memoryTotal, labels, d.MemoryTotalBytes)
+	}
+	for _, c := range cards {
+		labels := []string{c.UUID, strconv.Itoa(c.PhysicalNum), c.Resource}
+		set(seen, temperature, labels, c.TemperatureCelsius)
+		set(seen, powerUsage, labels, c.PowerWatts)
+	}
+	for v, series := range telemetrySeries {
+		for key, labels := range series {
+			if _, ok := seen[v][key]; !ok {
+				v.DeleteLabelValues(labels...)
+			}
+		}
+	}
+	telemetrySeries = seen
+}
+
+func set(seen map[*prometheus.GaugeVec]map[string][]string, v *prometheus.GaugeVec, labels []string, value *float64) {
+	if value == nil {
+		return
+	}
+	v.WithLabelValues(labels...).Set(*value)
+	if seen[v] == nil {
+		seen[v] = map[string][]string{}
+	}
+	seen[v][strings.Join(labels, "\x00")] = labels
+}
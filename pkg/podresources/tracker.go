@@ -0,0 +1,210 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package podresources
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/metrics"
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/utils"
+)
+
+const (
+	DefaultSocket    = "/var/lib/kubelet/pod-resources/kubelet.sock"
+	DefaultInterval  = 10 * time.Second
+	DefaultNamespace = "birentech.com"
+
+	requestTimeout = 10 * time.Second
+)
+
+// Allocation is a set of devices kubelet handed to a container.
+type Allocation struct {
+	Namespace string   `json:"namespace"`
+	Pod       string   `json:"pod"`
+	Container string   `json:"container"`
+	Resource  string   `json:"resource"`
+	DeviceIDs []string `json:"deviceIDs"`
+}
+
+// Tracker maps Biren device IDs to the containers holding them. The
+// PodResources API has no watch call, so the list is polled.
+type Tracker struct {
+	Socket   string
+	Interval time.Duration
+	// Namespace is the namespace of the resources tracked.
+	Namespace string
+
+	client podresourcesapi.PodResourcesListerClient
+
+	mu          sync.RWMutex
+	allocations []Allocation
+	devices     map[string]Allocation
+	lastErr     string
+}
+
+func NewTracker(socket string, interval time.Duration) *Tracker {
+	return &Tracker{Socket: socket, Interval: interval, Namespace: DefaultNamespace, devices: map[string]Allocation{}}
+}
+
+// Run polls kubelet until stop is closed.
+func (t *Tracker) Run(stop <-chan struct{}) {
+	conn, err := grpc.Dial("unix://"+t.Socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Errorf("dial pod resources socket %s failed %v", t.Socket, err)
+		return
+	}
+	defer conn.Close()
+	t.client = podresourcesapi.NewPodResourcesListerClient(conn)
+
+	interval := t.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		t.refreshAndLog()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshAndLog logs failures only when they change, kubelet may not offer
+// the socket for a long time.
+func (t *Tracker) refreshAndLog() {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	err := t.Refresh(ctx)
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if msg != t.lastErr {
+		if err != nil {
+			log.Errorf("list pod resources failed %v", err)
+		} else {
+			log.Info("Listing pod resources again")
+		}
+	}
+	t.lastErr = msg
+}
+
+// Refresh lists the pod resources once.
+func (t *Tracker) Refresh(ctx context.Context) error {
+	resp, err := t.client.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return err
+	}
+	t.update(resp.PodResources)
+	return nil
+}
+
+func (t *Tracker) update(pods []*podresourcesapi.PodResources) {
+	allocations := []Allocation{}
+	devices := map[string]Allocation{}
+	podDevices := []metrics.PodDevice{}
+	for _, pod := range pods {
+		for _, c := range pod.Containers {
+			for _, d := range c.Devices {
+				if !strings.HasPrefix(d.ResourceName, t.Namespace+"/") || len(d.DeviceIds) == 0 {
+					continue
+				}
+				a := Allocation{
+					Namespace: pod.Namespace,
+					Pod:       pod.Name,
+					Container: c.Name,
+					Resource:  d.ResourceName,
+					DeviceIDs: append([]string{}, d.DeviceIds...),
+				}
+				allocations = append(allocations, a)
+				for _, id := range d.DeviceIds {
+					devices[id] = a
+					// a replica of a shared device, like card_3::r0, also
+					// attributes the device to its first holder
+					if i := strings.Index(id, utils.DeviceIDSeparator); i > 0 {
+						if _, ok := devices[id[:i]]; !ok {
+							devices[id[:i]] = a
+						}
+					}
+					podDevices = append(podDevices, metrics.PodDevice{
+						Resource:  a.Resource,
+						DeviceID:  id,
+						Namespace: a.Namespace,
+						Pod:       a.Pod,
+						Container: a.Container,
+					})
+				}
+			}
+		}
+	}
+	sort.SliceStable(allocations, func(i, j int) bool {
+		a, b := allocations[i], allocations[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Pod != b.Pod {
+			return a.Pod < b.Pod
+		}
+		return a.Container < b.Container
+	})
+
+	t.mu.Lock()
+	t.allocations = allocations
+	t.devices = devices
+	t.mu.Unlock()
+	metrics.SetPodDevices(podDevices)
+}
+
+// Allocations returns the devices held by containers, ordered by pod.
+func (t *Tracker) Allocations() []Allocation {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]Allocation{}, t.allocations...)
+}
+
+// Lookup returns the container holding the device. It is safe to call on a
+// nil Tracker.
+func (t *Tracker) Lookup(deviceID string) (Allocation, bool) {
+	if t == nil {
+		return Allocation{}, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	a, ok := t.devices[deviceID]
+	return a, ok
+}
+
+// ServeHTTP writes the allocations as JSON.
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.Allocations()); err != nil {
+		log.Errorf("write allocations failed %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package podresources
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	"github.com/BirenTechnology/k8s-device-plugin/pkg/metrics"
+)
+
+type fakeLister struct {
+	pods []*podresourcesapi.PodResources
+	err  error
+}
+
+func (f *fakeLister) List(ctx context.Context, in *podresourcesapi.ListPodResourcesRequest, opts ...grpc.CallOption) (*podresourcesapi.ListPodResourcesResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &podresourcesapi.ListPodResourcesResponse{PodResources: f.pods}, nil
+}
+
+func (f *fakeLister) GetAllocatableResources(ctx context.Context, in *podresourcesapi.AllocatableResourcesRequest, opts ...grpc.CallOption) (*podresourcesapi.AllocatableResourcesResponse, error) {
+	return &podresourcesapi.AllocatableResourcesResponse{}, nil
+}
+
+func (f *fakeLister) Get(ctx context.Context, in *podresourcesapi.GetPodResourcesRequest, opts ...grpc.CallOption) (*podresourcesapi.GetPodResourcesResponse, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func pod(namespace, name string, containers ...*podresourcesapi.ContainerResources) *podresourcesapi.PodResources {
+	return &podresourcesapi.PodResources{Namespace: namespace, Name: name, Containers: containers}
+}
+
+func container(name string, resource string, ids ...string) *podresourcesapi.ContainerResources {
+	return &podresourcesapi.ContainerResources{
+		Name:    name,
+		Devices: []*podresourcesapi.ContainerDevices{{ResourceName: resource, DeviceIds: ids}},
+	}
+}
+
+func TestTracker(t *testing.T) {
+	lister := &fakeLister{pods: []*podresourcesapi.PodResources{
+		pod("team-b", "infer", container("main", "birentech.com/1-4-gpu", "card_4")),
+		pod("team-a", "train",
+			container("main", "birentech.com/gpu", "card_0", "card_1"),
+			container("nic", "example.com/nic", "eth1")),
+		pod("team-a", "web", container("main", "example.com/nic", "eth2")),
+		pod("team-c", "chat", container("main", "birentech.com/gpu.shared", "card_2::r1")),
+	}}
+	tr := NewTracker(DefaultSocket, 0)
+	tr.client = lister
+	assert.NoError(t, tr.Refresh(context.Background()))
+
+	assert.Equal(t, []Allocation{
+		{Namespace: "team-a", Pod: "train", Container: "main", Resource: "birentech.com/gpu", DeviceIDs: []string{"card_0", "card_1"}},
+		{Namespace: "team-b", Pod: "infer", Container: "main", Resource: "birentech.com/1-4-gpu", DeviceIDs: []string{"card_4"}},
+		{Namespace: "team-c", Pod: "chat", Container: "main", Resource: "birentech.com/gpu.shared", DeviceIDs: []string{"card_2::r1"}},
+	}, tr.Allocations())
+
+	a, ok := tr.Lookup("card_1")
+	assert.True(t, ok)
+	assert.Equal(t, "train", a.Pod)
+	// replicas attribute their card too
+	a, ok = tr.Lookup("card_2")
+	assert.True(t, ok)
+	assert.Equal(t, "chat", a.Pod)
+	_, ok = tr.Lookup("eth1")
+	assert.False(t, ok)
+	_, ok = (*Tracker)(nil).Lookup("card_1")
+	assert.False(t, ok)
+
+	rec := httptest.NewRecorder()
+	tr.ServeHTTP(rec, httptest.NewRequest("GET", "/allocations", nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	got := []Allocation{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	assert.Equal(t, tr.Allocations(), got)
+
+	rec = httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `birentech_device_plugin_pod_device_allocation{card_id="card_4",container="main",namespace="team-b",pod="infer",resource="birentech.com/1-4-gpu"} 1`)
+
+	// released devices are forgotten, failed lists keep the last answer
+	lister.pods = lister.pods[:1]
+	assert.NoError(t, tr.Refresh(context.Background()))
+	_, ok = tr.Lookup("card_0")
+	assert.False(t, ok)
+	lister.err = fmt.Errorf("kubelet restarting")
+	assert.Error(t, tr.Refresh(context.Background()))
+	_, ok = tr.Lookup("card_4")
+	assert.True(t, ok)
+}
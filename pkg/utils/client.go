@@ -15,17 +15,29 @@
 package utils
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
+	"k8s.io/client-go/util/retry"
 )
 
 type Client struct {
-	K8s *kubernetes.Clientset
+	K8s kubernetes.Interface
 }
 
 func NewClient(inCluster bool) (Client, error) {
@@ -57,3 +69,126 @@ func InCluster() bool {
 	}
 	return ic
 }
+
+// NodePods caches the pods bound to a node, so that looking them up on the
+// admission path of kubelet does not wait on the API server.
+type NodePods struct {
+	node   string
+	lister corelisters.PodLister
+	synced cache.InformerSynced
+}
+
+// WatchNodePods starts caching the pods bound to node until stop is closed.
+// It does not wait for the cache to sync.
+func (c Client) WatchNodePods(stop <-chan struct{}, node string) *NodePods {
+	factory := informers.NewSharedInformerFactoryWithOptions(c.K8s, 0, informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+		o.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", node).String()
+	}))
+	pods := factory.Core().V1().Pods()
+	n := &NodePods{node: node, lister: pods.Lister(), synced: pods.Informer().HasSynced}
+	factory.Start(stop)
+	return n
+}
+
+// HasSynced tells whether the cache has listed the pods of the node.
+func (n *NodePods) HasSynced() bool {
+	return n.synced()
+}
+
+// Pending returns the cached pods of the node that have not started yet.
+func (n *NodePods) Pending() ([]corev1.Pod, error) {
+	if !n.synced() {
+		return nil, fmt.Errorf("pods of node %s not synced yet", n.node)
+	}
+	pods, err := n.lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	res := []corev1.Pod{}
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodPending {
+			res = append(res, *pod)
+		}
+	}
+	return res, nil
+}
+
+// UpdateNodeLabels sets labels on node and removes the other labels starting
+// with prefix. The node is only written when its labels change.
+func (c Client) UpdateNodeLabels(node string, prefix string, labels map[string]string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		n, err := c.K8s.CoreV1().Nodes().Get(context.TODO(), node, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if n.Labels == nil {
+			n.Labels = map[string]string{}
+		}
+		changed := false
+		for k := range n.Labels {
+			if _, ok := labels[k]; !ok && strings.HasPrefix(k, prefix) {
+				delete(n.Labels, k)
+				changed = true
+			}
+		}
+		for k, v := range labels {
+			if old, ok := n.Labels[k]; !ok || old != v {
+				n.Labels[k] = v
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		_, err = c.K8s.CoreV1().Nodes().Update(context.TODO(), n, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// WatchNodeConfigMap calls onChange with the labels of node and the data of
+// the ConfigMap namespace/name every time either changes, until stop is
+// closed. A missing ConfigMap has no data. It returns once both are synced,
+// after calling onChange with the synced state.
+func (c Client) WatchNodeConfigMap(stop <-chan struct{}, node string, namespace string, name string, onChange func(labels map[string]string, data map[string]string)) error {
+	byName := func(name string) informers.SharedInformerOption {
+		return informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		})
+	}
+	nodeFactory := informers.NewSharedInformerFactoryWithOptions(c.K8s, 0, byName(node))
+	cmFactory := informers.NewSharedInformerFactoryWithOptions(c.K8s, 0, byName(name), informers.WithNamespace(namespace))
+	nodes := nodeFactory.Core().V1().Nodes().Informer()
+	cms := cmFactory.Core().V1().ConfigMaps().Informer()
+
+	var mu sync.Mutex
+	notify := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		var labels, data map[string]string
+		if obj, ok, _ := nodes.GetStore().GetByKey(node); ok {
+			labels = obj.(*corev1.Node).Labels
+		}
+		if obj, ok, _ := cms.GetStore().GetByKey(namespace + "/" + name); ok {
+			data = obj.(*corev1.ConfigMap).Data
+		}
+		onChange(labels, data)
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { notify() },
+		UpdateFunc: func(interface{}, interface{}) { notify() },
+		DeleteFunc: func(interface{}) { notify() },
+	}
+	for _, informer := range []cache.SharedIndexInformer{nodes, cms} {
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return err
+		}
+	}
+
+	nodeFactory.Start(stop)
+	cmFactory.Start(stop)
+	if !cache.WaitForCacheSync(stop, nodes.HasSynced, cms.HasSynced) {
+		return fmt.Errorf("sync node %s and configmap %s/%s failed", node, namespace, name)
+	}
+	notify()
+	return nil
+}
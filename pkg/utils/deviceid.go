@@ -0,0 +1,20 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//     http://www.apache.org/licenses/LICENSE-2.0
+// 
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package utils
+
+// DeviceIDSeparator joins a device ID and the number of one of its replicas
+// or memory units, like card_3::r0. The device plugin names devices with it
+// and the pod resources tracker attributes them back to their device.
+const DeviceIDSeparator = "::"
@@ -0,0 +1,349 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//     http://www.apache.org/licenses/LICENSE-2.0
+// 
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package utils
+
+import (
+	"sort"
+)
+
+const (
+	// exactSearchLimit is the largest graph solved by branch and bound,
+	// larger graphs use greedy selection refined by local search.
+	exactSearchLimit = 20
+	// exactSearchBudget bounds the search tree nodes visited by branch and
+	// bound, the best set found so far is returned when it runs out.
+	exactSearchBudget = 100000
+	// localSearchRounds bounds the improving swaps made after greedy selection.
+	localSearchRounds = 64
+
+	// localityScale weights P2P values against locality so that a better
+	// P2P link always outweighs the locality of a pair, the locality of a
+	// pair stays below it.
+	localityScale   = 8
+	sameNUMA        = 2
+	sameRootComplex = 1
+	samePCIeSwitch  = 2
+	samePhysical    = 2
+)
+
+// BestSet returns x nodes with the highest bridge value. On graphs of up to
+// exactSearchLimit nodes it returns the same value as MaxValCount, on larger
+// graphs it returns a good set in bounded time.
+func (g *Graph) BestSet(x int) (int, []string) {
+	return g.BestSetWith(nil, x)
+}
+
+// BestSetWith is BestSet for sets that must contain the must nodes. When must
+// already holds x or more nodes it is returned unchanged.
+func (g *Graph) BestSetWith(must []string, x int) (int, []string) {
+	if x < 1 || x > len(g.nodes) {
+		return 0, nil
+	}
+	if len(must) >= x {
+		return g.bridgeVal(must), must
+	}
+	if len(must) == 0 && len(g.nodes) == 1 {
+		return 10, []string{g.nodes[0].Name}
+	}
+	if len(must) == 0 && x == 1 {
+		return 1, []string{g.nodes[0].Name}
+	}
+
+	w := g.pairWeights()
+	fixed := make([]bool, len(g.nodes))
+	for i, n := range g.nodes {
+		fixed[i] = exist(n.Name, must)
+	}
+	free := []int{}
+	for i := range g.nodes {
+		if !fixed[i] {
+			free = append(free, i)
+		}
+	}
+	sub := make([][]int, len(free))
+	base := make([]int, len(free))
+	for a, i := range free {
+		sub[a] = make([]int, len(free))
+		for b, j := range free {
+			sub[a][b] = w[i][j]
+		}
+		for f := range g.nodes {
+			if fixed[f] {
+				base[a] += w[f][i]
+			}
+		}
+	}
+
+	chosen := make([]bool, len(g.nodes))
+	for _, a := range newSubsetSearch(sub, base, x-len(must)).run() {
+		chosen[free[a]] = true
+	}
+	names := []string{}
+	for _, n := range must {
+		if !g.hasNode(n) {
+			names = append(names, n)
+		}
+	}
+	for i, n := range g.nodes {
+		if fixed[i] || chosen[i] {
+			names = append(names, n.Name)
+		}
+	}
+	return g.bridgeVal(names), names
+}
+
+func (g *Graph) hasNode(name string) bool {
+	for _, n := range g.nodes {
+		if n.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// pairWeights returns the symmetric matrix of pair weights between the nodes
+// of g, indexed like g.nodes. A weight is the edge value seen from both ends
+// scaled by localityScale plus the locality of the pair.
+func (g *Graph) pairWeights() [][]int {
+	index := make(map[string]int, len(g.nodes))
+	for i, n := range g.nodes {
+		index[n.Name] = i
+	}
+	w := make([][]int, len(g.nodes))
+	for i := range w {
+		w[i] = make([]int, len(g.nodes))
+	}
+	for i, n := range g.nodes {
+		for _, e := range g.edges[n.Name] {
+			j, ok := index[e.node.Name]
+			if !ok || j == i {
+				continue
+			}
+			w[i][j] += e.val * localityScale
+			w[j][i] += e.val * localityScale
+		}
+	}
+	for i, a := range g.nodes {
+		for j := i + 1; j < len(g.nodes); j++ {
+			l := g.locality(a.Name, g.nodes[j].Name)
+			w[i][j] += l
+			w[j][i] += l
+		}
+	}
+	return w
+}
+
+// locality scores how close two devices are on the host, pairs on the same
+// NUMA node, root complex or PCIe switch talk through fewer hops, and SVI
+// instances of the same physical card share its memory.
+func (g *Graph) locality(u, v string) int {
+	a, ok := g.attrs[u]
+	if !ok {
+		return 0
+	}
+	b, ok := g.attrs[v]
+	if !ok {
+		return 0
+	}
+	l := 0
+	if a.NUMA >= 0 && a.NUMA == b.NUMA {
+		l += sameNUMA
+	}
+	if a.RootComplex != "" && a.RootComplex == b.RootComplex {
+		l += sameRootComplex
+	}
+	if a.Switch != "" && a.Switch == b.Switch {
+		l += samePCIeSwitch
+	}
+	if a.Physical >= 0 && a.Physical == b.Physical {
+		l += samePhysical
+	}
+	return l
+}
+
+// subsetSearch picks k indexes maximizing the sum of w over their pairs plus
+// base over their members.
+type subsetSearch struct {
+	w    [][]int
+	base []int
+	k    int
+	// prefix[i][t] is the sum of the t largest weights of node i.
+	prefix [][]int
+
+	best    int
+	bestSet []int
+	steps   int
+}
+
+func newSubsetSearch(w [][]int, base []int, k int) *subsetSearch {
+	s := &subsetSearch{w: w, base: base, k: k, prefix: make([][]int, len(w))}
+	for i, row := range w {
+		sorted := make([]int, 0, len(row))
+		for j, v := range row {
+			if j != i {
+				sorted = append(sorted, v)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+		s.prefix[i] = make([]int, len(sorted)+1)
+		for t, v := range sorted {
+			s.prefix[i][t+1] = s.prefix[i][t] + v
+		}
+	}
+	return s
+}
+
+func (s *subsetSearch) run() []int {
+	if s.k == 0 {
+		return nil
+	}
+	set, val := s.greedy()
+	set, val = s.improve(set, val)
+	if len(s.w) > exactSearchLimit {
+		sort.Ints(set)
+		return set
+	}
+
+	// Branch and bound visits sets in the same order as subset(), so among
+	// sets of equal value the one MaxValCount would pick is kept.
+	s.best, s.bestSet = val-1, set
+	s.steps = 0
+	gain := append([]int{}, s.base...)
+	s.branch(0, nil, 0, gain)
+	return s.bestSet
+}
+
+// greedy grows a set from every start node by repeatedly adding the node
+// with the largest gain and returns the best of them.
+func (s *subsetSearch) greedy() ([]int, int) {
+	n := len(s.w)
+	var best []int
+	bestVal := -1
+	for start := 0; start < n; start++ {
+		in := make([]bool, n)
+		gain := append([]int{}, s.base...)
+		set := []int{}
+		val := 0
+		add := func(i int) {
+			in[i] = true
+			set = append(set, i)
+			val += gain[i]
+			for j := range gain {
+				gain[j] += s.w[i][j]
+			}
+		}
+		add(start)
+		for len(set) < s.k {
+			next := -1
+			for j := 0; j < n; j++ {
+				if !in[j] && (next < 0 || gain[j] > gain[next]) {
+					next = j
+				}
+			}
+			add(next)
+		}
+		if val > bestVal {
+			best, bestVal = set, val
+		}
+	}
+	return best, bestVal
+}
+
+// improve applies the best improving swap of one member for one outsider
+// until no swap helps or localSearchRounds is reached.
+func (s *subsetSearch) improve(set []int, val int) ([]int, int) {
+	n := len(s.w)
+	in := make([]bool, n)
+	for _, i := range set {
+		in[i] = true
+	}
+	for round := 0; round < localSearchRounds; round++ {
+		gain := append([]int{}, s.base...)
+		for _, i := range set {
+			for j := 0; j < n; j++ {
+				gain[j] += s.w[i][j]
+			}
+		}
+		bestDelta, bestPos, bestOut := 0, -1, -1
+		for pos, u := range set {
+			for v := 0; v < n; v++ {
+				if in[v] {
+					continue
+				}
+				delta := gain[v] - s.w[u][v] - gain[u]
+				if delta > bestDelta {
+					bestDelta, bestPos, bestOut = delta, pos, v
+				}
+			}
+		}
+		if bestPos < 0 {
+			break
+		}
+		in[set[bestPos]] = false
+		in[bestOut] = true
+		set[bestPos] = bestOut
+		val += bestDelta
+	}
+	return set, val
+}
+
+// branch extends set with nodes from start on. gain[j] holds the value node j
+// would add to set.
+func (s *subsetSearch) branch(start int, set []int, val int, gain []int) {
+	if s.steps >= exactSearchBudget {
+		return
+	}
+	s.steps++
+	if len(set) == s.k {
+		if val > s.best {
+			s.best = val
+			s.bestSet = append([]int{}, set...)
+		}
+		return
+	}
+	r := s.k - len(set)
+	if len(s.w)-start < r {
+		return
+	}
+	if s.bound(start, r, val, gain) <= 2*s.best {
+		return
+	}
+	for i := start; i <= len(s.w)-r; i++ {
+		next := val + gain[i]
+		for j := range gain {
+			gain[j] += s.w[i][j]
+		}
+		s.branch(i+1, append(set, i), next, gain)
+		for j := range gain {
+			gain[j] -= s.w[i][j]
+		}
+	}
+}
+
+// bound returns twice an upper bound of the value reachable by adding r nodes
+// from start on: each candidate adds its gain plus at most half of its r-1
+// largest weights.
+func (s *subsetSearch) bound(start, r, val int, gain []int) int {
+	cand := make([]int, 0, len(s.w)-start)
+	for c := start; c < len(s.w); c++ {
+		cand = append(cand, 2*gain[c]+s.prefix[c][r-1])
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(cand)))
+	b := 2 * val
+	for _, v := range cand[:r] {
+		b += v
+	}
+	return b
+}
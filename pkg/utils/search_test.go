@@ -0,0 +1,274 @@
+// Copyright 2024 Shanghai Biren Technology Co., Ltd.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//     http://www.apache.org/licenses/LICENSE-2.0
+// 
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package utils
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func randomGraph(r *rand.Rand, n int) *Graph {
+	g := &Graph{}
+	nodes := []*Node{}
+	for i := 0; i < n; i++ {
+		node := &Node{Name: fmt.Sprintf("card_%d", i)}
+		nodes = append(nodes, node)
+		g.AddNode(node)
+	}
+	scores := []int{1, 4, 9}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			g.AddEdge(nodes[i], nodes[j], scores[r.Intn(len(scores))])
+		}
+	}
+	return g
+}
+
+func TestBestSetMatchesMaxValCount(t *testing.T) {
+	graphs := []*Graph{
+		string2Graph(`
+  A        B       C        D 
+A x   single  multiple multiple 
+B single   x multiple   multiple 
+C multiple   multiple x multiple 
+D multiple   multiple multiple x 
+`),
+		string2Graph(`
+  A           B         C         D         E        F        G        H 
+A x           single    multiple  multiple  node     node     node     node 
+B single      x         multiple  multiple  node     node     node     node
+C multiple    multiple  x         multiple  node     node     node     node
+D multiple    multiple  multiple  x         node     node     node     node   
+E node        node      node      node      x        single   multiple multiple
+F node        node      node      node      single   x        multiple multiple
+G node        node      node      node      multiple multiple x        multiple
+H node        node      node      node      multiple multiple multiple x 
+`),
+	}
+	r := rand.New(rand.NewSource(1))
+	for n := 2; n <= 12; n++ {
+		graphs = append(graphs, randomGraph(r, n))
+	}
+
+	for gi, g := range graphs {
+		for k := 1; k <= len(g.nodes); k++ {
+			want, wantSet := g.MaxValCount(k)
+			got, gotSet := g.BestSet(k)
+			assert.Equal(t, want, got, "graph %d size %d", gi, k)
+			assert.Equal(t, want, g.bridgeVal(gotSet), "graph %d size %d", gi, k)
+			assert.Len(t, gotSet, k)
+			if want > 0 {
+				assert.Equal(t, wantSet, gotSet, "graph %d size %d", gi, k)
+			}
+		}
+	}
+}
+
+func TestBestSetEdgeCases(t *testing.T) {
+	g := randomGraph(rand.New(rand.NewSource(1)), 4)
+	score, set := g.BestSet(0)
+	assert.Equal(t, 0, score)
+	assert.Nil(t, set)
+	score, set = g.BestSet(5)
+	assert.Equal(t, 0, score)
+	assert.Nil(t, set)
+
+	single := &Graph{}
+	single.AddNode(&Node{Name: "card_0"})
+	score, set = single.BestSet(1)
+	assert.Equal(t, 10, score)
+	assert.Equal(t, []string{"card_0"}, set)
+}
+
+func TestBestSetLargeGraph(t *testing.T) {
+	// Two islands of 32 fully linked cards: the best 16 lie in one island.
+	g := &Graph{}
+	nodes := []*Node{}
+	for i := 0; i < 64; i++ {
+		node := &Node{Name: fmt.Sprintf("card_%d", i)}
+		nodes = append(nodes, node)
+		g.AddNode(node)
+	}
+	for i := 0; i < 64; i++ {
+		for j := i + 1; j < 64; j++ {
+			val := 1
+			if i%2 == j%2 {
+				val = 9
+			}
+			g.AddEdge(nodes[i], nodes[j], val)
+		}
+	}
+	score, set := g.BestSet(16)
+	assert.Equal(t, 9*16*15/2, score)
+	assert.Len(t, set, 16)
+}
+
+func TestBestSetSelectedNodes(t *testing.T) {
+	g := randomGraph(rand.New(rand.NewSource(1)), 64)
+	nodes := []*Node{}
+	for _, n := range g.nodes[:48] {
+		nodes = append(nodes, &Node{Name: n.Name})
+	}
+	for _, k := range []int{2, 4, 8, 16, 32} {
+		_, set := g.SelectNodes(nodes).BestSet(k)
+		assert.Len(t, set, k)
+	}
+}
+
+func BenchmarkBestSet(b *testing.B) {
+	for _, n := range []int{8, 16, 20, 32, 64} {
+		for _, k := range []int{2, 4, 8, 16} {
+			if k > n {
+				continue
+			}
+			g := randomGraph(rand.New(rand.NewSource(1)), n)
+			b.Run(fmt.Sprintf("devices=%d/size=%d", n, k), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					g.BestSet(k)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkMaxValCount(b *testing.B) {
+	for _, n := range []int{8, 16} {
+		g := randomGraph(rand.New(rand.NewSource(1)), n)
+		b.Run(fmt.Sprintf("devices=%d/size=4", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				g.MaxValCount(4)
+			}
+		})
+	}
+}
+
+func TestBestSetWith(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for n := 3; n <= 10; n++ {
+		g := randomGraph(r, n)
+		names := []string{}
+		for _, node := range g.nodes {
+			names = append(names, node.Name)
+		}
+		for k := 2; k <= n; k++ {
+			must := []string{names[r.Intn(n)]}
+			if k > 2 {
+				must = append(must, names[(r.Intn(n-1)+1+indexOf(names, must[0]))%n])
+			}
+
+			want := 0
+			for _, ss := range subset(names, k) {
+				if containsAll(ss, must) && g.bridgeVal(ss) > want {
+					want = g.bridgeVal(ss)
+				}
+			}
+			got, set := g.BestSetWith(must, k)
+			assert.Equal(t, want, got, "size %d must %v", k, must)
+			assert.Len(t, set, k)
+			assert.True(t, containsAll(set, must), "set %v must %v", set, must)
+		}
+	}
+
+	g := randomGraph(r, 4)
+	score, set := g.BestSetWith([]string{"card_3", "card_1"}, 2)
+	assert.Equal(t, g.bridgeVal([]string{"card_3", "card_1"}), score)
+	assert.Equal(t, []string{"card_3", "card_1"}, set)
+}
+
+func indexOf(ss []string, s string) int {
+	for i, v := range ss {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func containsAll(set, must []string) bool {
+	for _, m := range must {
+		if !exist(m, set) {
+			return false
+		}
+	}
+	return true
+}
+
+func localityGraph(vals map[[2]int]int, attrs []NodeAttr) *Graph {
+	g := &Graph{}
+	nodes := []*Node{}
+	for i, attr := range attrs {
+		node := &Node{Name: fmt.Sprintf("card_%d", i)}
+		nodes = append(nodes, node)
+		g.AddNode(node)
+		g.SetNodeAttr(node.Name, attr)
+	}
+	for i := range nodes {
+		for j := i + 1; j < len(nodes); j++ {
+			val, ok := vals[[2]int{i, j}]
+			if !ok {
+				val = 4
+			}
+			g.AddEdge(nodes[i], nodes[j], val)
+		}
+	}
+	return g
+}
+
+func TestBestSetLocality(t *testing.T) {
+	// P2P ties everywhere, the pair on one NUMA node wins.
+	g := localityGraph(nil, []NodeAttr{{NUMA: 0}, {NUMA: 1}, {NUMA: 0}, {NUMA: 1}})
+	_, set := g.BestSet(2)
+	assert.Equal(t, []string{"card_0", "card_2"}, set)
+
+	// The same switch outweighs the same NUMA node.
+	g = localityGraph(nil, []NodeAttr{
+		{NUMA: 0, RootComplex: "pci0000:00", Switch: "0000:01:00.0"},
+		{NUMA: 0, RootComplex: "pci0000:40", Switch: "0000:41:00.0"},
+		{NUMA: 1, RootComplex: "pci0000:00", Switch: "0000:01:00.0"},
+		{NUMA: 1, RootComplex: "pci0000:80", Switch: "0000:81:00.0"},
+	})
+	_, set = g.BestSet(2)
+	assert.Equal(t, []string{"card_0", "card_2"}, set)
+
+	// A better P2P link always wins over locality.
+	g = localityGraph(map[[2]int]int{{1, 3}: 9}, []NodeAttr{
+		{NUMA: 0, Switch: "0000:01:00.0"}, {NUMA: 1}, {NUMA: 0, Switch: "0000:01:00.0"}, {NUMA: 0},
+	})
+	_, set = g.BestSet(2)
+	assert.Equal(t, []string{"card_1", "card_3"}, set)
+
+	// Unknown NUMA nodes are not a match.
+	g = localityGraph(nil, []NodeAttr{{NUMA: -1}, {NUMA: 0}, {NUMA: -1}, {NUMA: 0}})
+	_, set = g.BestSet(2)
+	assert.Equal(t, []string{"card_1", "card_3"}, set)
+
+	sub := g.SelectNodes([]*Node{{Name: "card_1"}, {Name: "card_3"}})
+	attr, ok := sub.NodeAttr("card_3")
+	assert.True(t, ok)
+	assert.Equal(t, 0, attr.NUMA)
+
+	// SVI instances of one physical card go together.
+	g = localityGraph(nil, []NodeAttr{{NUMA: 0, Physical: 0}, {NUMA: 0, Physical: 1}, {NUMA: 0, Physical: 2}, {NUMA: 0, Physical: 1}})
+	_, set = g.BestSet(2)
+	assert.Equal(t, []string{"card_1", "card_3"}, set)
+
+	// The closest pair still scores below one step of P2P.
+	closest := NodeAttr{NUMA: 0, RootComplex: "pci0000:00", Switch: "0000:01:00.0", Physical: 0}
+	g = localityGraph(nil, []NodeAttr{closest, closest})
+	assert.Less(t, g.locality("card_0", "card_1"), localityScale)
+}
@@ -29,9 +29,45 @@ type nodeWithVal struct {
 	node *Node
 }
 
+// NodeAttr describes where a device sits on the host.
+type NodeAttr struct {
+	// NUMA is the NUMA node of the device, -1 when unknown.
+	NUMA int
+	// RootComplex is the PCI root bus the device hangs off, like pci0000:00.
+	RootComplex string
+	// Switch is the upstream port of the first PCIe switch below the root
+	// port, or the root port when there is no switch.
+	Switch string
+	// Physical is the index of the physical card an SVI instance belongs to,
+	// -1 when unknown.
+	Physical int
+}
+
 type Graph struct {
 	nodes []*Node
 	edges map[string][]nodeWithVal
+	attrs map[string]NodeAttr
+}
+
+func (g *Graph) SetNodeAttr(name string, attr NodeAttr) {
+	if g.attrs == nil {
+		g.attrs = make(map[string]NodeAttr)
+	}
+	g.attrs[name] = attr
+}
+
+func (g *Graph) NodeAttr(name string) (NodeAttr, bool) {
+	attr, ok := g.attrs[name]
+	return attr, ok
+}
+
+// NodeNames returns the names of the nodes in the order they were added.
+func (g *Graph) NodeNames() []string {
+	res := make([]string, 0, len(g.nodes))
+	for _, n := range g.nodes {
+		res = append(res, n.Name)
+	}
+	return res
 }
 
 func (g *Graph) AddEdge(u, v *Node, val int) {
@@ -59,6 +95,7 @@ func (g *Graph) DeleteNode(n *Node) *Graph {
 	newGraph := &Graph{
 		nodes: []*Node{},
 		edges: map[string][]nodeWithVal{},
+		attrs: g.attrs,
 	}
 	for _, v := range g.nodes {
 		if v.Name != n.Name {
@@ -100,23 +137,24 @@ func (g *Graph) SelectNodes(nodes []*Node) *Graph {
 }
 
 func (g *Graph) String() string {
-	str := ""
+	var b strings.Builder
 	for k, iNode := range g.nodes {
-		str += iNode.String() + " -> "
-		nexts := g.edges[iNode.Name]
+		b.WriteString(iNode.String() + " -> ")
+		// sort a copy, String may run while the graph is searched
+		nexts := append([]nodeWithVal{}, g.edges[iNode.Name]...)
 		sort.SliceStable(nexts, func(i, j int) bool {
 			si := strings.Split(nexts[i].node.Name, "-")
 			sj := strings.Split(nexts[j].node.Name, "-")
 			return si[len(si)-1] < sj[len(sj)-1]
 		})
 		for _, next := range nexts {
-			str += next.node.String() + fmt.Sprintf("(%d) ", next.val)
+			fmt.Fprintf(&b, "%s(%d) ", next.node.String(), next.val)
 		}
 		if k != len(g.nodes)-1 {
-			str += "\n"
+			b.WriteString("\n")
 		}
 	}
-	return str
+	return b.String()
 }
 
 func (n *Node) String() string {
@@ -37,7 +37,7 @@ func TestGrap(t *testing.T) {
 	g.AddEdge(&b, &d, 1)
 	g.AddEdge(&c, &d, 2)
 
-	g.String()
+	t.Log(g.String())
 }
 
 func TestSubset(t *testing.T) {